@@ -14,9 +14,14 @@ type Answer struct {
 	// Indexed by variable name.
 	Solution Substitution `json:"answer"`
 	// Stdout is captured standard output text from this query.
+	// It is empty if the query's output was streamed using [WithStdout].
 	Stdout string
 	// Stderr is captured standard error text from this query.
+	// It is empty if the query's output was streamed using [WithStderr].
 	Stderr string
+	// Truncated is true if some of this answer's output was discarded
+	// for exceeding the limit set by [WithMaxOutput].
+	Truncated bool
 }
 
 type response struct {
@@ -25,7 +30,10 @@ type response struct {
 	Error  json.RawMessage // ball
 }
 
-func (pl *prolog) parse(goal, answer, stdout, stderr string) (Answer, error) {
+// parse decodes an answer to q.
+// truncated is whether some of its output was discarded.
+func (pl *prolog) parse(q *query, answer, stdout, stderr string, truncated bool) (Answer, error) {
+	goal := q.goal
 	// log.Println("parse:", goal, "stdout:", stdout, "stderr:", stderr)
 	if len(strings.TrimSpace(answer)) == 0 {
 		return Answer{}, fmt.Errorf("empty answer")
@@ -42,9 +50,10 @@ func (pl *prolog) parse(goal, answer, stdout, stderr string) (Answer, error) {
 
 	resp := response{
 		Answer: Answer{
-			Query:  goal,
-			Stdout: stdout,
-			Stderr: stderr,
+			Query:     goal,
+			Stdout:    stdout,
+			Stderr:    stderr,
+			Truncated: truncated,
 		},
 	}
 
@@ -60,13 +69,13 @@ func (pl *prolog) parse(goal, answer, stdout, stderr string) (Answer, error) {
 	case statusSuccess:
 		return resp.Answer, nil
 	case statusFailure:
-		return resp.Answer, ErrFailure{Query: goal, Stdout: stdout, Stderr: stderr}
+		return resp.Answer, ErrFailure{Query: goal, Stdout: stdout, Stderr: stderr, Truncated: truncated}
 	case statusError:
 		ball, err := unmarshalTerm(resp.Error)
 		if err != nil {
 			return resp.Answer, err
 		}
-		return resp.Answer, ErrThrow{Query: goal, Ball: ball, Stdout: stdout, Stderr: stderr}
+		return resp.Answer, ErrThrow{Query: goal, Ball: ball, Stdout: stdout, Stderr: stderr, Truncated: truncated, cause: q.goError(ball)}
 	default:
 		return resp.Answer, fmt.Errorf("trealla: unexpected query status: %v", resp.Status)
 	}
@@ -1,6 +1,7 @@
 package trealla
 
 import (
+	"bytes"
 	"context"
 	"strings"
 	"testing"
@@ -54,6 +55,28 @@ func BenchmarkClone(b *testing.B) {
 	}
 }
 
+func BenchmarkNewFromSnapshot(b *testing.B) {
+	pl, err := New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := pl.ConsultText(context.Background(), "user", strings.Repeat("hello(world). ", 1024)); err != nil {
+		b.Fatal(err)
+	}
+	snap, err := pl.Snapshot()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pl, err := NewFromSnapshot(bytes.NewReader(snap))
+		if err != nil {
+			b.Fatal(err)
+		}
+		pl.Close()
+	}
+}
+
 func BenchmarkRedo(b *testing.B) {
 	pl, err := New()
 	if err != nil {
@@ -0,0 +1,231 @@
+package trealla
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// consultChunkSize is roughly how much text ConsultReader loads at a time.
+const consultChunkSize = 64 * 1024
+
+func (pl *prolog) ConsultFS(ctx context.Context, fsys fs.FS, name string, options ...ConsultOption) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return io.EOF
+	}
+	return pl.consultFS(ctx, fsys, name, options...)
+}
+
+func (pl *prolog) consultFS(ctx context.Context, fsys fs.FS, name string, options ...ConsultOption) error {
+	if !fs.ValidPath(name) {
+		return fmt.Errorf("trealla: failed to consult file: %s: %w", name, fs.ErrInvalid)
+	}
+	root, detach := pl.mounts.attach(fsys)
+	defer detach()
+
+	// Relative paths in directives are resolved against the working directory,
+	// so it's the root of fsys while consulting.
+	// The interpreter can't go back to "/" unless it was mounted, so fall back to mountDir.
+	//	working_directory(Old, Root),
+	//	call_cleanup(consult(File), catch(working_directory(_, Old), _, working_directory(_, MountDir))).
+	old := Variable{Name: "Old"}
+	goal := Atom(",").Of(
+		Atom("working_directory").Of(old, Atom(root)),
+		Atom("call_cleanup").Of(
+			Atom("consult").Of(Atom(path.Join(root, name))),
+			Atom("catch").Of(
+				Atom("working_directory").Of(Variable{Name: "_"}, old),
+				Variable{Name: "_"},
+				Atom("working_directory").Of(Variable{Name: "_"}, Atom(mountDir)),
+			),
+		),
+	)
+	ans, err := pl.queryOnce(ctx, goal.String()+".")
+	if err != nil {
+		return fmt.Errorf("trealla: failed to consult file: %s: %w", name, err)
+	}
+	c := newConsultation(name, options)
+	c.root = root
+	c.check(ans, 0)
+	return c.err()
+}
+
+func (pl *prolog) ConsultReader(ctx context.Context, module string, r io.Reader, options ...ConsultOption) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return io.EOF
+	}
+	return pl.consultReader(ctx, module, r, options...)
+}
+
+func (pl *prolog) consultReader(ctx context.Context, module string, r io.Reader, options ...ConsultOption) error {
+	c := newConsultation("", options)
+	sc := clauseScanner{r: bufio.NewReader(r)}
+	line := 1
+	for {
+		text, err := sc.next(consultChunkSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("trealla: consult text failed: %w", err)
+		}
+		if strings.TrimSpace(text) != "" {
+			// load_text(Text, [module(Module)]).
+			goal := Atom("load_text").Of(text, []Term{Atom("module").Of(Atom(module))})
+			ans, err := pl.queryOnce(ctx, goal.String())
+			if err != nil {
+				return fmt.Errorf("trealla: consult text failed: %w", err)
+			}
+			c.check(ans, line)
+		}
+		if err != nil {
+			break
+		}
+		line += strings.Count(text, "\n")
+	}
+	return c.err()
+}
+
+// clauseScanner splits Prolog text into chunks of whole clauses,
+// so that it can be loaded a piece at a time.
+type clauseScanner struct {
+	r *bufio.Reader
+}
+
+// next returns the next size bytes of text or so, rounded up to the end of a clause.
+// It returns io.EOF along with the rest of the text at the end of the input.
+func (s *clauseScanner) next(size int) (string, error) {
+	var sb strings.Builder
+	for sb.Len() < size {
+		if err := s.clause(&sb); err != nil {
+			return sb.String(), err
+		}
+	}
+	return sb.String(), nil
+}
+
+// clause copies text up to and including the end token (a period followed by layout) of the next clause.
+func (s *clauseScanner) clause(sb *strings.Builder) error {
+	var prev, prev2 rune
+	for {
+		c, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(c)
+		switch {
+		case c == '%':
+			if err := s.until(sb, "\n"); err != nil {
+				return err
+			}
+			c = '\n'
+		case c == '/' && s.peek() == '*':
+			s.r.ReadRune()
+			sb.WriteRune('*')
+			if err := s.until(sb, "*/"); err != nil {
+				return err
+			}
+			c = ' '
+		case c == '\'' && prev == '0' && !isAlnum(prev2):
+			// character code: 0'c
+			if err := s.char(sb); err != nil {
+				return err
+			}
+			c = 'c'
+		case c == '\'' || c == '"' || c == '`':
+			if err := s.quoted(sb, c); err != nil {
+				return err
+			}
+		case c == '.' && !isSymbolChar(prev):
+			next := s.peek()
+			if next == -1 || next == '%' || unicode.IsSpace(next) {
+				return nil
+			}
+		}
+		prev2, prev = prev, c
+	}
+}
+
+// until copies text up to and including end.
+func (s *clauseScanner) until(sb *strings.Builder, end string) error {
+	var seen []rune
+	for !strings.HasSuffix(string(seen), end) {
+		c, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(c)
+		seen = append(seen, c)
+		if len(seen) > len(end) {
+			seen = seen[1:]
+		}
+	}
+	return nil
+}
+
+// quoted copies a quoted atom or string up to and including the closing quote.
+func (s *clauseScanner) quoted(sb *strings.Builder, quote rune) error {
+	for {
+		c, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(c)
+		switch {
+		case c == '\\':
+			c, _, err := s.r.ReadRune()
+			if err != nil {
+				return err
+			}
+			sb.WriteRune(c)
+		case c == quote && s.peek() == quote:
+			// doubled quote
+			s.r.ReadRune()
+			sb.WriteRune(c)
+		case c == quote:
+			return nil
+		}
+	}
+}
+
+// char copies the character of a character code literal (0'c).
+func (s *clauseScanner) char(sb *strings.Builder) error {
+	c, _, err := s.r.ReadRune()
+	if err != nil {
+		return err
+	}
+	sb.WriteRune(c)
+	if c == '\\' || (c == '\'' && s.peek() == '\'') {
+		c, _, err := s.r.ReadRune()
+		if err != nil {
+			return err
+		}
+		sb.WriteRune(c)
+	}
+	return nil
+}
+
+// peek returns the next rune without consuming it, or -1 at the end of the input.
+func (s *clauseScanner) peek() rune {
+	c, _, err := s.r.ReadRune()
+	if err != nil {
+		return -1
+	}
+	s.r.UnreadRune()
+	return c
+}
+
+func isSymbolChar(c rune) bool {
+	return strings.ContainsRune(`+-*/\^<>=~:.?@#&$`, c)
+}
+
+func isAlnum(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
@@ -0,0 +1,308 @@
+package trealla
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Severity is the severity of a [Diagnostic].
+type Severity string
+
+const (
+	// SeverityError is for problems that prevent code from loading, such as syntax errors.
+	SeverityError Severity = "error"
+	// SeverityWarning is for suspicious code that loads anyway, such as singleton variables.
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is an error or warning reported by the interpreter while consulting Prolog code.
+type Diagnostic struct {
+	Severity Severity
+	// File is the file that was consulted. It is empty for [Prolog.ConsultText].
+	File string
+	// Line is the line number reported by the interpreter, starting from 1, or 0 if unknown.
+	Line int
+	// Column is the column of Token in Line, starting from 1, or 0 if unknown.
+	// The interpreter doesn't report columns, so it is currently always 0.
+	Column int
+	// Token is the offending token of a syntax error, if known.
+	Token string
+	// Message describes the problem, such as "operator expected" or "singleton: X".
+	Message string
+	// Syntax is true for syntax errors.
+	Syntax bool
+}
+
+// String returns the diagnostic in the form file:line:column: severity: message.
+func (d Diagnostic) String() string {
+	var sb strings.Builder
+	if pos := position(d.File, d.Line, d.Column); pos != "" {
+		sb.WriteString(pos)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(string(d.Severity))
+	sb.WriteString(": ")
+	if d.Syntax {
+		sb.WriteString("syntax error: ")
+	}
+	sb.WriteString(d.Message)
+	if d.Token != "" {
+		fmt.Fprintf(&sb, " (near %q)", d.Token)
+	}
+	return sb.String()
+}
+
+// syntaxError converts a syntax error diagnostic to a [SyntaxError].
+func (d Diagnostic) syntaxError() SyntaxError {
+	return SyntaxError{
+		Description: Atom(strings.ReplaceAll(d.Message, " ", "_")),
+		File:        d.File,
+		Line:        d.Line,
+		Column:      d.Column,
+		Token:       d.Token,
+		Message:     d.Message,
+	}
+}
+
+// ConsultError is returned by [Prolog.Consult] and [Prolog.ConsultText]
+// when the interpreter reports errors, such as syntax errors, while loading code.
+// Use [errors.As] with [SyntaxError] to find the first syntax error.
+// Note that the interpreter stops reading a file at its first syntax error.
+type ConsultError struct {
+	// File is the file that was consulted. It is empty for [Prolog.ConsultText].
+	File string
+	// Diagnostics are all the errors and warnings that were reported, in order.
+	Diagnostics []Diagnostic
+}
+
+// Error implements the error interface.
+func (err ConsultError) Error() string {
+	var sb strings.Builder
+	if err.File == "" {
+		sb.WriteString("trealla: consult text failed")
+	} else {
+		fmt.Fprintf(&sb, "trealla: failed to consult file: %s", err.File)
+	}
+	var n int
+	for _, d := range err.Diagnostics {
+		if d.Severity != SeverityError {
+			continue
+		}
+		if n == 0 {
+			sb.WriteString(": ")
+			sb.WriteString(d.String())
+		}
+		n++
+	}
+	if n > 1 {
+		fmt.Fprintf(&sb, " (and %d more errors)", n-1)
+	}
+	return sb.String()
+}
+
+// Unwrap returns a [SyntaxError] for each syntax error.
+func (err ConsultError) Unwrap() []error {
+	var errs []error
+	for _, d := range err.Diagnostics {
+		if d.Severity == SeverityError && d.Syntax {
+			errs = append(errs, d.syntaxError())
+		}
+	}
+	return errs
+}
+
+// ConsultOption is an optional parameter for [Prolog.Consult] and [Prolog.ConsultText].
+type ConsultOption func(*consultation)
+
+type consultation struct {
+	diagnostics func(Diagnostic)
+	// file is the name of the file being consulted, or empty for text
+	file string
+	// root is trimmed from file names reported by the interpreter
+	root  string
+	diags []Diagnostic
+}
+
+// WithDiagnostics calls fn for each error and warning reported while consulting,
+// including warnings that don't cause an error to be returned. This is useful for linting.
+func WithDiagnostics(fn func(Diagnostic)) ConsultOption {
+	return func(c *consultation) {
+		c.diagnostics = fn
+	}
+}
+
+func newConsultation(file string, options []ConsultOption) *consultation {
+	c := &consultation{file: file}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// check collects the diagnostics printed while loading a file or,
+// if c.file is empty, text starting at the given line.
+func (c *consultation) check(ans Answer, line int) {
+	var diags []Diagnostic
+	for _, output := range []string{ans.Stdout, ans.Stderr} {
+		for _, msg := range strings.Split(output, "\n") {
+			d, ok := parseDiagnostic(msg)
+			if !ok {
+				continue
+			}
+			if c.file == "" {
+				d.File = ""
+				if d.Line > 0 {
+					d.Line += line - 1
+				}
+			} else if c.root != "" {
+				d.File = strings.TrimPrefix(d.File, c.root+"/")
+			}
+			diags = append(diags, d)
+		}
+	}
+	// errors and warnings are printed to different streams
+	slices.SortStableFunc(diags, func(a, b Diagnostic) int {
+		return a.Line - b.Line
+	})
+	if c.diagnostics != nil {
+		for _, d := range diags {
+			c.diagnostics(d)
+		}
+	}
+	c.diags = append(c.diags, diags...)
+}
+
+// err returns a ConsultError if any errors were reported.
+func (c *consultation) err() error {
+	for _, d := range c.diags {
+		if d.Severity == SeverityError {
+			return ConsultError{File: c.file, Diagnostics: c.diags}
+		}
+	}
+	return nil
+}
+
+// The interpreter prints diagnostics to the same streams as directives' output,
+// so only lines in the interpreter's own formats are diagnostics:
+//
+//	Error: syntax error, near '2', operator expected, /foo.pl:6
+//	Error: instantiation error, /foo.pl:3
+//	Warning: singleton: X, near /foo.pl:1
+//	Error: unknown directive: foo/1
+//	Warning: overwriting 'foo'/1
+var (
+	locatedDiagnostic   = regexp.MustCompile(`^(Error|Warning): (.+), (near )?([^,]+):([1-9][0-9]*)$`)
+	unlocatedDiagnostic = regexp.MustCompile(`^(?:Error: (unknown directive: .+/[0-9]+)|Warning: (overwriting .+/[0-9]+))$`)
+)
+
+// loadErrors are the messages of the errors, other than syntax errors, that the interpreter reports while loading code.
+var loadErrors = []string{
+	"could not set op",
+	"instantiation error",
+	"max arity reached",
+	"max vars reached",
+	"module creation failed: ",
+	"module name not an atom",
+	"no permission to modify static predicate ",
+	"permission to import into ",
+	"pragma name not an atom",
+	"predicate creation failed",
+	"predicate export failed, ",
+	"type error, callable",
+	"type error, not callable",
+	"unknown op",
+	"unknown value",
+	"var pool exhausted",
+}
+
+// parseDiagnostic parses an error or warning printed by the interpreter.
+// It reports false for lines that don't match the interpreter's formats.
+func parseDiagnostic(line string) (Diagnostic, bool) {
+	var d Diagnostic
+	if m := unlocatedDiagnostic.FindStringSubmatch(line); m != nil {
+		if m[1] != "" {
+			d.Severity, d.Message = SeverityError, m[1]
+		} else {
+			d.Severity, d.Message = SeverityWarning, m[2]
+		}
+		return d, true
+	}
+
+	m := locatedDiagnostic.FindStringSubmatch(line)
+	if m == nil {
+		return d, false
+	}
+	line, near := m[2], m[3] != ""
+	syntax := line == "syntax error" || strings.HasPrefix(line, "syntax error, ")
+	switch {
+	case m[1] == "Warning" && near && strings.HasPrefix(line, "singleton: "):
+		d.Severity = SeverityWarning
+	case m[1] == "Error" && syntax && (!near || line == "syntax error"):
+		d.Severity = SeverityError
+	case m[1] == "Error" && !near && slices.ContainsFunc(loadErrors, func(msg string) bool {
+		return strings.HasPrefix(line, msg)
+	}):
+		d.Severity = SeverityError
+	default:
+		return d, false
+	}
+	d.File = m[4]
+	d.Line, _ = strconv.Atoi(m[5])
+
+	if rest, ok := strings.CutPrefix(line, "syntax error, "); ok {
+		line = rest
+		if rest, ok := strings.CutPrefix(line, "near "); ok {
+			if token, msg, ok := cutToken(rest); ok {
+				d.Token = unquoteAtom(token)
+				line = msg
+			}
+		}
+	}
+	d.Syntax = syntax
+	d.Message = line
+	return d, true
+}
+
+// cutToken splits the token of a syntax error from the rest of the message.
+// The interpreter quotes tokens with single or double quotes without escaping them,
+// so a quoted token ends at the first closing quote followed by a comma.
+func cutToken(text string) (token, rest string, ok bool) {
+	sep := ", "
+	if text != "" && (text[0] == '\'' || text[0] == '"') {
+		sep = text[:1] + sep
+		if i := strings.Index(text[1:], sep); i >= 0 {
+			return text[:i+2], text[i+1+len(sep):], true
+		}
+		sep = ", "
+	}
+	return strings.Cut(text, sep)
+}
+
+// unquoteAtom removes the quotes from a quoted atom such as 'foo”s' or a string such as "foo".
+func unquoteAtom(text string) string {
+	if len(text) < 2 || (text[0] != '\'' && text[0] != '"') || text[len(text)-1] != text[0] {
+		return text
+	}
+	q := text[:1]
+	return strings.ReplaceAll(text[1:len(text)-1], q+q, q)
+}
+
+// position formats a source position as file:line:column, omitting unknown parts.
+func position(file string, line, col int) string {
+	var sb strings.Builder
+	sb.WriteString(file)
+	if line > 0 {
+		if file != "" {
+			sb.WriteByte(':')
+		}
+		sb.WriteString(strconv.Itoa(line))
+		if col > 0 {
+			sb.WriteByte(':')
+			sb.WriteString(strconv.Itoa(col))
+		}
+	}
+	return sb.String()
+}
@@ -37,6 +37,8 @@ func marshal(term Term) (string, error) {
 		return x.String(), nil
 	case Variable:
 		return x.String(), nil
+	case handleTerm:
+		return x.term().String(), nil
 	case compoundStruct:
 		c, err := encodeCompoundStruct(term)
 		if err != nil {
@@ -3,6 +3,7 @@ package trealla
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // ErrFailure is returned when a query fails (when it finds no solutions).
@@ -13,6 +14,9 @@ type ErrFailure struct {
 	Stdout string
 	// Stderr output from the query (useful for traces).
 	Stderr string
+	// Truncated is true if some of the query's output was discarded
+	// for exceeding the limit set by [WithMaxOutput].
+	Truncated bool
 }
 
 // Error implements the error interface.
@@ -35,6 +39,12 @@ type ErrThrow struct {
 	Stdout string
 	// Stderr output from the query (useful for traces).
 	Stderr string
+	// Truncated is true if some of the query's output was discarded
+	// for exceeding the limit set by [WithMaxOutput].
+	Truncated bool
+
+	// Go error thrown by a predicate, see ThrowError
+	cause error
 }
 
 // Error implements the error interface.
@@ -42,6 +52,332 @@ func (err ErrThrow) Error() string {
 	return fmt.Sprintf("trealla: exception thrown: %v", err.Ball)
 }
 
+// Unwrap returns the Go error thrown by a predicate with [ThrowError],
+// or the typed ISO error (such as [TypeError]) for error(Formal, Context) balls,
+// so they can be inspected with [errors.Is] and [errors.As]. It returns nil for other balls.
+func (err ErrThrow) Unwrap() error {
+	if err.cause != nil {
+		return err.cause
+	}
+	return isoError(err.Ball)
+}
+
+// ThrowError returns a throw/1 term that a predicate can return to throw err as a Prolog exception.
+// pl and subquery should be the ones passed to the predicate.
+//
+// [ErrThrow] errors are thrown as their ball.
+// ISO errors such as [TypeError], or errors wrapping them, are thrown as their term.
+// Other errors are thrown as error(system_error(go_error(Handle, Message)), _),
+// where Handle refers to err (see [Handle]).
+// If the exception isn't caught, the query's error unwraps to err.
+func ThrowError(pl Prolog, subquery Subquery, err error) Compound {
+	var ex ErrThrow
+	if errors.As(err, &ex) && ex.cause == nil {
+		return throwTerm(ex.Ball)
+	}
+	if ex.cause != nil {
+		// re-throwing an error from a nested query, whose handle dies with it
+		err = ex.cause
+	}
+	var iso interface{ Term() Compound }
+	if errors.As(err, &iso) {
+		return throwTerm(iso.Term())
+	}
+	h := NewHandle(pl, subquery, err)
+	return throwTerm(isoTerm(Atom("system_error").Of(Atom("go_error").Of(h, err.Error())), nil))
+}
+
+// goError returns the Go error thrown by ThrowError for ball, if it is still alive and q can use it.
+func (q *query) goError(ball Term) error {
+	cmp, ok := ball.(Compound)
+	if !ok || cmp.Functor != "error" || len(cmp.Args) != 2 {
+		return nil
+	}
+	formal, ok := cmp.Args[0].(Compound)
+	if !ok || formal.Functor != "system_error" || len(formal.Args) != 1 {
+		return nil
+	}
+	goerr, ok := formal.Args[0].(Compound)
+	if !ok || goerr.Functor != "go_error" || len(goerr.Args) != 2 {
+		return nil
+	}
+	h, err := HandleOf[error](goerr.Args[0])
+	if err != nil {
+		return nil
+	}
+	v, _ := q.handle(h.ID)
+	cause, _ := v.(error)
+	return cause
+}
+
+// ErrCanceled is returned when a query is aborted because its context was canceled
+// or its deadline was exceeded. The interpreter remains usable afterwards.
+type ErrCanceled struct {
+	// Query is the original query goal.
+	Query string
+	// Cause is the reason the context was canceled, such as [context.Canceled] or [context.DeadlineExceeded].
+	Cause error
+}
+
+// Error implements the error interface.
+func (err ErrCanceled) Error() string {
+	return fmt.Sprintf("trealla: canceled: %v", err.Cause)
+}
+
+// Unwrap returns the context error that caused the cancellation.
+func (err ErrCanceled) Unwrap() error {
+	return err.Cause
+}
+
+// IsCanceled returns true if the given error is a canceled query error (ErrCanceled).
+func IsCanceled(err error) bool {
+	return errors.As(err, &ErrCanceled{})
+}
+
+// TypeError is an ISO type error: error(type_error(Type, Culprit), Context).
+type TypeError struct {
+	// Type is the expected type, such as integer or callable.
+	Type    Atom
+	Culprit Term
+	Context Term
+}
+
+// Error implements the error interface.
+func (err TypeError) Error() string {
+	return isoString(Atom("type_error").Of(err.Type, err.Culprit), err.Context)
+}
+
+// Term returns the error term: error(type_error(Type, Culprit), Context).
+func (err TypeError) Term() Compound {
+	return isoTerm(Atom("type_error").Of(err.Type, err.Culprit), err.Context)
+}
+
+// DomainError is an ISO domain error: error(domain_error(Domain, Culprit), Context).
+type DomainError struct {
+	// Domain is the expected domain, such as not_less_than_zero.
+	Domain  Atom
+	Culprit Term
+	Context Term
+}
+
+// Error implements the error interface.
+func (err DomainError) Error() string {
+	return isoString(Atom("domain_error").Of(err.Domain, err.Culprit), err.Context)
+}
+
+// Term returns the error term: error(domain_error(Domain, Culprit), Context).
+func (err DomainError) Term() Compound {
+	return isoTerm(Atom("domain_error").Of(err.Domain, err.Culprit), err.Context)
+}
+
+// ExistenceError is an ISO existence error: error(existence_error(Type, Culprit), Context).
+type ExistenceError struct {
+	// Type is the kind of thing that doesn't exist, such as procedure or source_sink.
+	Type    Atom
+	Culprit Term
+	Context Term
+}
+
+// Error implements the error interface.
+func (err ExistenceError) Error() string {
+	return isoString(Atom("existence_error").Of(err.Type, err.Culprit), err.Context)
+}
+
+// Term returns the error term: error(existence_error(Type, Culprit), Context).
+func (err ExistenceError) Term() Compound {
+	return isoTerm(Atom("existence_error").Of(err.Type, err.Culprit), err.Context)
+}
+
+// PermissionError is an ISO permission error: error(permission_error(Action, Type, Culprit), Context).
+// The two-argument form permission_error(Action, Culprit) is also recognized, in which case Type is empty.
+type PermissionError struct {
+	// Action is the forbidden action, such as modify or open.
+	Action Atom
+	// Type is the type of Culprit, such as static_procedure or source_sink.
+	Type    Atom
+	Culprit Term
+	Context Term
+}
+
+func (err PermissionError) formal() Compound {
+	if err.Type == "" {
+		return Atom("permission_error").Of(err.Action, err.Culprit)
+	}
+	return Atom("permission_error").Of(err.Action, err.Type, err.Culprit)
+}
+
+// Error implements the error interface.
+func (err PermissionError) Error() string {
+	return isoString(err.formal(), err.Context)
+}
+
+// Term returns the error term: error(permission_error(Action, Type, Culprit), Context).
+func (err PermissionError) Term() Compound {
+	return isoTerm(err.formal(), err.Context)
+}
+
+// ResourceError is an ISO resource error: error(resource_error(Resource), Context).
+type ResourceError struct {
+	// Resource is the exhausted resource, such as memory.
+	Resource Term
+	Context  Term
+}
+
+// Error implements the error interface.
+func (err ResourceError) Error() string {
+	return isoString(Atom("resource_error").Of(err.Resource), err.Context)
+}
+
+// Term returns the error term: error(resource_error(Resource), Context).
+func (err ResourceError) Term() Compound {
+	return isoTerm(Atom("resource_error").Of(err.Resource), err.Context)
+}
+
+// SyntaxError is an ISO syntax error: error(syntax_error(Description), Context).
+// Syntax errors found by [Prolog.ConsultText] and [Prolog.Consult] also have a position, see [ConsultError].
+// The interpreter doesn't report positions for syntax errors in queries.
+type SyntaxError struct {
+	// Description is the kind of syntax error, such as operator_expected.
+	Description Term
+	Context     Term
+
+	// File is the consulted file, if any.
+	File string
+	// Line is the line of the error, starting from 1, or 0 if unknown.
+	Line int
+	// Column is the column of Token in Line, starting from 1, or 0 if unknown.
+	// The interpreter doesn't report columns, so it is currently always 0.
+	Column int
+	// Token is the offending token, if known.
+	Token string
+	// Message describes the error, such as "operator expected".
+	Message string
+}
+
+// Error implements the error interface.
+func (err SyntaxError) Error() string {
+	if err.Line == 0 {
+		return isoString(Atom("syntax_error").Of(err.Description), err.Context)
+	}
+	text := fmt.Sprintf("trealla: syntax error: %s: %s", position(err.File, err.Line, err.Column), err.Message)
+	if err.Token != "" {
+		text += fmt.Sprintf(" (near %q)", err.Token)
+	}
+	return text
+}
+
+// Term returns the error term: error(syntax_error(Description), Context).
+func (err SyntaxError) Term() Compound {
+	return isoTerm(Atom("syntax_error").Of(err.Description), err.Context)
+}
+
+// EvaluationError is an ISO evaluation error: error(evaluation_error(Error), Context).
+type EvaluationError struct {
+	// Kind is the arithmetic error, such as zero_divisor or undefined.
+	Kind    Atom
+	Context Term
+}
+
+// Error implements the error interface.
+func (err EvaluationError) Error() string {
+	return isoString(Atom("evaluation_error").Of(err.Kind), err.Context)
+}
+
+// Term returns the error term: error(evaluation_error(Kind), Context).
+func (err EvaluationError) Term() Compound {
+	return isoTerm(Atom("evaluation_error").Of(err.Kind), err.Context)
+}
+
+// InstantiationError is an ISO instantiation error: error(instantiation_error, Context).
+type InstantiationError struct {
+	Context Term
+}
+
+// Error implements the error interface.
+func (err InstantiationError) Error() string {
+	return isoString(Atom("instantiation_error"), err.Context)
+}
+
+// Term returns the error term: error(instantiation_error, Context).
+func (err InstantiationError) Term() Compound {
+	return isoTerm(Atom("instantiation_error"), err.Context)
+}
+
+// isoError decodes an error(Formal, Context) ball into its typed error, or returns nil.
+func isoError(ball Term) error {
+	cmp, ok := ball.(Compound)
+	if !ok || cmp.Functor != "error" || len(cmp.Args) != 2 {
+		return nil
+	}
+	ctx := cmp.Args[1]
+	if formal, ok := cmp.Args[0].(Atom); ok && formal == "instantiation_error" {
+		return InstantiationError{Context: ctx}
+	}
+	formal, ok := cmp.Args[0].(Compound)
+	if !ok {
+		return nil
+	}
+	args := formal.Args
+	switch {
+	case formal.Functor == "type_error" && len(args) == 2:
+		if typ, ok := args[0].(Atom); ok {
+			return TypeError{Type: typ, Culprit: args[1], Context: ctx}
+		}
+	case formal.Functor == "domain_error" && len(args) == 2:
+		if domain, ok := args[0].(Atom); ok {
+			return DomainError{Domain: domain, Culprit: args[1], Context: ctx}
+		}
+	case formal.Functor == "existence_error" && len(args) == 2:
+		if typ, ok := args[0].(Atom); ok {
+			return ExistenceError{Type: typ, Culprit: args[1], Context: ctx}
+		}
+	case formal.Functor == "permission_error" && len(args) == 3:
+		action, ok1 := args[0].(Atom)
+		typ, ok2 := args[1].(Atom)
+		if ok1 && ok2 {
+			return PermissionError{Action: action, Type: typ, Culprit: args[2], Context: ctx}
+		}
+	case formal.Functor == "permission_error" && len(args) == 2:
+		if action, ok := args[0].(Atom); ok {
+			return PermissionError{Action: action, Culprit: args[1], Context: ctx}
+		}
+	case formal.Functor == "resource_error" && len(args) == 1:
+		return ResourceError{Resource: args[0], Context: ctx}
+	case formal.Functor == "syntax_error" && len(args) == 1:
+		var msg string
+		if desc, ok := args[0].(Atom); ok {
+			msg = strings.ReplaceAll(string(desc), "_", " ")
+		}
+		return SyntaxError{Description: args[0], Context: ctx, Message: msg}
+	case formal.Functor == "evaluation_error" && len(args) == 1:
+		if what, ok := args[0].(Atom); ok {
+			return EvaluationError{Kind: what, Context: ctx}
+		}
+	}
+	return nil
+}
+
+func isoTerm(formal, ctx Term) Compound {
+	if ctx == nil {
+		ctx = Variable{Name: "_"}
+	}
+	return Atom("error").Of(formal, ctx)
+}
+
+func isoString(formal, ctx Term) string {
+	text, err := marshal(formal)
+	if err != nil {
+		text = fmt.Sprintf("%v", formal)
+	}
+	if ctx == nil {
+		return "trealla: " + text
+	}
+	if _, ok := ctx.(Variable); ok {
+		return "trealla: " + text
+	}
+	return fmt.Sprintf("trealla: %s (context: %v)", text, ctx)
+}
+
 func errUnexported(symbol string) error {
 	return fmt.Errorf("trealla: failed to get wasm exported function: %q (symbol not found)", symbol)
 }
@@ -49,4 +385,14 @@ func errUnexported(symbol string) error {
 var (
 	_ error = ErrFailure{}
 	_ error = ErrThrow{}
+	_ error = ErrCanceled{}
+
+	_ error = TypeError{}
+	_ error = DomainError{}
+	_ error = ExistenceError{}
+	_ error = PermissionError{}
+	_ error = ResourceError{}
+	_ error = SyntaxError{}
+	_ error = EvaluationError{}
+	_ error = InstantiationError{}
 )
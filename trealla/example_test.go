@@ -142,6 +142,29 @@ func Example_register() {
 	// Output: NBSWY3DP
 }
 
+func Example_register_func() {
+	ctx := context.Background()
+	pl, err := trealla.New()
+	if err != nil {
+		panic(err)
+	}
+
+	// The same base32 predicate as above, in one line.
+	// Type checking and errors are taken care of for us.
+	// base32(+Input, -Output) is det.
+	pl.RegisterFunc(ctx, "base32", func(input string) string {
+		return base32.StdEncoding.EncodeToString([]byte(input))
+	})
+
+	// Try it out.
+	answer, err := pl.QueryOnce(ctx, `base32("hello", Encoded).`)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(answer.Solution["Encoded"])
+	// Output: NBSWY3DP
+}
+
 func Example_register_nondet() {
 	ctx := context.Background()
 	pl, err := trealla.New()
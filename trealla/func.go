@@ -0,0 +1,224 @@
+package trealla
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	errorType   = reflect.TypeFor[error]()
+	bigIntType  = reflect.TypeFor[*big.Int]()
+)
+
+func (pl *prolog) RegisterFunc(ctx context.Context, name string, fn any, opts ...RegisterOption) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return io.EOF
+	}
+	return pl.registerFunc(ctx, name, fn, opts...)
+}
+
+func (pl *prolog) registerFunc(ctx context.Context, name string, fn any, opts ...RegisterOption) error {
+	proc, arity, err := funcPredicate(Atom(name), fn)
+	if err != nil {
+		return err
+	}
+	return pl.register(ctx, name, arity, proc, opts...)
+}
+
+// funcPredicate adapts a Go function to a Predicate, see [Prolog.RegisterFunc].
+// It returns the predicate and its arity.
+func funcPredicate(name Atom, fn any) (Predicate, int, error) {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return nil, 0, fmt.Errorf("trealla: can't register %s: not a function: %T", name, fn)
+	}
+	ftype := fv.Type()
+	if ftype.IsVariadic() {
+		return nil, 0, fmt.Errorf("trealla: can't register %s: variadic functions are not supported", name)
+	}
+
+	withCtx := ftype.NumIn() > 0 && ftype.In(0) == contextType
+	withErr := ftype.NumOut() > 0 && ftype.Out(ftype.NumOut()-1) == errorType
+	var ins, outs []reflect.Type
+	for i := 0; i < ftype.NumIn(); i++ {
+		if i == 0 && withCtx {
+			continue
+		}
+		ins = append(ins, ftype.In(i))
+	}
+	for i := 0; i < ftype.NumOut(); i++ {
+		if i == ftype.NumOut()-1 && withErr {
+			continue
+		}
+		outs = append(outs, ftype.Out(i))
+	}
+	arity := len(ins) + len(outs)
+	pi := piTerm(name, arity)
+
+	proc := func(pl Prolog, subquery Subquery, goal Term) Term {
+		cmp, ok := goal.(Compound)
+		if !ok || len(cmp.Args) != arity {
+			return systemError(pi)
+		}
+
+		args := make([]reflect.Value, 0, ftype.NumIn())
+		if withCtx {
+			args = append(args, reflect.ValueOf(QueryContext(pl)))
+		}
+		for i, t := range ins {
+			arg, ex := decodeArg(t, cmp.Args[i], pi)
+			if ex != nil {
+				return ex
+			}
+			args = append(args, arg)
+		}
+
+		results := fv.Call(args)
+		if withErr {
+			if err, _ := results[len(results)-1].Interface().(error); err != nil {
+				return ThrowError(pl, subquery, err)
+			}
+			results = results[:len(results)-1]
+		}
+
+		unify := make([]Term, arity)
+		copy(unify, cmp.Args[:len(ins)])
+		for i, result := range results {
+			x := encodeResult(result)
+			if _, err := marshal(x); err != nil {
+				return systemError(err.Error())
+			}
+			unify[len(ins)+i] = x
+		}
+		return cmp.Functor.Of(unify...)
+	}
+	return proc, arity, nil
+}
+
+// decodeArg converts a predicate argument to a Go value of type t,
+// or returns an exception term if it can't.
+func decodeArg(t reflect.Type, arg Term, pi Term) (reflect.Value, Term) {
+	v := reflect.New(t).Elem()
+	if t == termType {
+		if arg != nil {
+			v.Set(reflect.ValueOf(arg))
+		}
+		return v, nil
+	}
+	if _, ok := arg.(Variable); ok {
+		return v, instantiationError(pi)
+	}
+
+	mismatch := func() (reflect.Value, Term) {
+		return v, typeError(typeName(t), arg, pi)
+	}
+	switch {
+	case t == atomType:
+		if _, ok := arg.(Atom); !ok {
+			return mismatch()
+		}
+	case t == bigIntType:
+		switch x := arg.(type) {
+		case int64:
+			v.Set(reflect.ValueOf(big.NewInt(x)))
+			return v, nil
+		case *big.Int:
+		default:
+			return mismatch()
+		}
+	case t.Kind() == reflect.Bool:
+		switch arg {
+		case Atom("true"):
+			v.SetBool(true)
+		case Atom("false"):
+		default:
+			return mismatch()
+		}
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
+		n, ok := arg.(int64)
+		if !ok {
+			return mismatch()
+		}
+		if v.OverflowInt(n) {
+			return v, representationError(Atom(t.Kind().String()), pi)
+		}
+	case reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		n, ok := arg.(int64)
+		if !ok {
+			return mismatch()
+		}
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return v, representationError(Atom(t.Kind().String()), pi)
+		}
+	case reflect.Float64, reflect.Float32:
+		switch arg.(type) {
+		case int64, float64:
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		switch x := arg.(type) {
+		case string, Atom:
+		case []Term:
+			// the empty string is the empty list
+			if len(x) == 0 {
+				return v, nil
+			}
+			return mismatch()
+		default:
+			return mismatch()
+		}
+	}
+
+	if err := convert(v, reflect.ValueOf(arg), reflect.StructField{}); err != nil {
+		return mismatch()
+	}
+	return v, nil
+}
+
+// typeName returns the name of the Prolog type that converts to t, for type errors.
+func typeName(t reflect.Type) Atom {
+	switch {
+	case t == atomType:
+		return "atom"
+	case t == bigIntType:
+		return "integer"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8,
+		reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		return "integer"
+	case reflect.Float64, reflect.Float32:
+		return "number"
+	case reflect.String:
+		return "chars"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Struct:
+		return "compound"
+	}
+	return "callable"
+}
+
+// encodeResult converts a Go function's return value to a term.
+func encodeResult(v reflect.Value) Term {
+	if v.Kind() == reflect.Bool {
+		if v.Bool() {
+			return Atom("true")
+		}
+		return Atom("false")
+	}
+	return v.Interface()
+}
@@ -0,0 +1,192 @@
+package trealla
+
+import (
+	"fmt"
+)
+
+// Handle is an opaque reference to a Go value of type T.
+// It lets predicates pass Go values that can't (or shouldn't) be converted to terms,
+// such as database cursors or large structs, to other predicates by way of Prolog.
+// In Prolog, handles look like '$go'(ID).
+//
+// Handles belong to the query that created them and are released when it is closed,
+// or earlier with [Handle.Release].
+// Predicates can only use the handles of the query calling them
+// (or of the queries whose predicates started it, see [Prolog.Call]).
+// Releasing a handle only forgets the reference; values that need cleaning up
+// (for example, an [io.Closer]) should be cleaned up by the predicates that use them.
+type Handle[T any] struct {
+	ID int64
+}
+
+// handleFunctor is the functor of the Prolog representation of a [Handle].
+const handleFunctor Atom = "$go"
+
+type handler interface {
+	handleNew(subq Subquery, value any) int64
+	handleGet(id int64) (any, bool)
+	handleRelease(id int64)
+}
+
+// NewHandle stores value in pl and returns a handle to it.
+// pl and subquery should be the ones passed to the predicate creating the handle,
+// which ties the handle's lifetime to that query.
+// Handles created outside of a query live as long as the interpreter, unless they are released.
+func NewHandle[T any](pl Prolog, subquery Subquery, value T) Handle[T] {
+	id := pl.(handler).handleNew(subquery, value)
+	return Handle[T]{ID: id}
+}
+
+// HandleOf converts the Prolog representation of a handle back into a Handle.
+// It returns an error if term is not a handle.
+// It does not check whether the handle is still alive, see [Handle.Value].
+func HandleOf[T any](term Term) (Handle[T], error) {
+	if cmp, ok := term.(Compound); ok && cmp.Functor == handleFunctor && len(cmp.Args) == 1 {
+		if id, ok := cmp.Args[0].(int64); ok {
+			return Handle[T]{ID: id}, nil
+		}
+	}
+	return Handle[T]{}, fmt.Errorf("trealla: not a handle: %v", term)
+}
+
+// Value returns the Go value h refers to.
+// It returns false if the handle was released, doesn't refer to a T,
+// or belongs to a query that pl (as passed to a predicate) can't use.
+func (h Handle[T]) Value(pl Prolog) (T, bool) {
+	v, ok := pl.(handler).handleGet(h.ID)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	value, ok := v.(T)
+	return value, ok
+}
+
+// Release forgets the value h refers to, so it can be garbage collected.
+// pl is the same as for [Handle.Value]; releasing a handle pl can't use does nothing.
+func (h Handle[T]) Release(pl Prolog) {
+	pl.(handler).handleRelease(h.ID)
+}
+
+// Term returns the Prolog representation of h: '$go'(ID).
+func (h Handle[T]) Term() Term {
+	return h.term()
+}
+
+func (h Handle[T]) term() Compound {
+	return handleFunctor.Of(h.ID)
+}
+
+// String returns the Prolog text representation of h.
+func (h Handle[T]) String() string {
+	return h.term().String()
+}
+
+type handleTerm interface {
+	term() Compound
+}
+
+func (pl *prolog) handleNew(subq Subquery, value any) int64 {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.newHandle(subq, value)
+}
+
+func (pl *prolog) handleGet(id int64) (any, bool) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	v, ok := pl.handles[id]
+	return v.value, ok
+}
+
+func (pl *prolog) handleRelease(id int64) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.releaseHandle(id)
+}
+
+// handleValue is a value stored by [NewHandle].
+type handleValue struct {
+	value any
+	// the query that created it, or nil if it belongs to the interpreter
+	owner *query
+}
+
+func (pl *prolog) newHandle(subq Subquery, value any) int64 {
+	pl.handlen++
+	id := pl.handlen
+	query := pl.subquery(uint32(subq))
+	pl.handles[id] = handleValue{value: value, owner: query}
+	if query != nil {
+		if query.handles == nil {
+			query.handles = make(map[int64]struct{})
+		}
+		query.handles[id] = struct{}{}
+	}
+	return id
+}
+
+func (pl *prolog) releaseHandle(id int64) {
+	v, ok := pl.handles[id]
+	if !ok {
+		return
+	}
+	delete(pl.handles, id)
+	if v.owner != nil {
+		delete(v.owner.handles, id)
+	}
+}
+
+// handle returns the value of a handle that q can use:
+// one created by q, by a query whose predicate started q, or outside of a query.
+// Handle IDs are easy to guess, so this keeps queries from using each other's.
+func (q *query) handle(id int64) (any, bool) {
+	v, ok := q.pl.handles[id]
+	if !ok {
+		return nil, false
+	}
+	if v.owner == nil {
+		return v.value, true
+	}
+	for user := q; user != nil; user = user.parent {
+		if v.owner == user {
+			return v.value, true
+		}
+	}
+	return nil, false
+}
+
+func (pl *lockedProlog) handleNew(subq Subquery, value any) int64 {
+	if err := pl.ensure(); err != nil {
+		return 0
+	}
+	return pl.prolog.newHandle(subq, value)
+}
+
+func (pl *lockedProlog) handleGet(id int64) (any, bool) {
+	if err := pl.ensure(); err != nil {
+		return nil, false
+	}
+	if pl.query != nil {
+		return pl.query.handle(id)
+	}
+	v, ok := pl.prolog.handles[id]
+	return v.value, ok
+}
+
+func (pl *lockedProlog) handleRelease(id int64) {
+	if err := pl.ensure(); err != nil {
+		return
+	}
+	if pl.query != nil {
+		if _, ok := pl.query.handle(id); !ok {
+			return
+		}
+	}
+	pl.prolog.releaseHandle(id)
+}
+
+var (
+	_ handler = (*prolog)(nil)
+	_ handler = (*lockedProlog)(nil)
+)
@@ -0,0 +1,118 @@
+package trealla
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// hostModule is the module the interpreter imports its host functions from.
+const hostModule = "trealla"
+
+// HostFunction is an extra function for custom builds of the interpreter to import,
+// such as builtins written in C that call out to Go. See [WithHostFunctions].
+type HostFunction struct {
+	// Module is the import module. The default is "trealla", the module of the built-in host functions.
+	Module string
+	// Name is the import name.
+	Name string
+	// Params and Results are the function's wasm signature.
+	Params  []api.ValueType
+	Results []api.ValueType
+	// Func implements the function, reading its parameters from stack and writing its results back to it,
+	// like [api.GoModuleFunction].
+	// pl is the interpreter that called it and subquery is the running query, or 0 if there is none.
+	// ctx is the query's context, see [QueryContext].
+	// pl is only valid until Func returns, like the one passed to a [Predicate].
+	Func func(ctx context.Context, pl Prolog, subquery Subquery, mod api.Module, stack []uint64)
+}
+
+// hostFunctions is a set of extra host functions. Runtimes are keyed by its address.
+type hostFunctions struct {
+	fns []HostFunction
+}
+
+// WithHostFunctions makes fns available for the interpreter's wasm to import.
+// Use with [WithWASM] to run a build of Trealla that imports them.
+//
+// Interpreters created with the same WithHostFunctions option share a runtime,
+// but each call to WithHostFunctions creates a new one,
+// so create the option once and reuse it.
+func WithHostFunctions(fns ...HostFunction) Option {
+	host := &hostFunctions{fns: slices.Clone(fns)}
+	return func(pl *prolog) {
+		pl.host = host
+	}
+}
+
+// instantiate adds the host functions to engine, along with the built-in ones.
+func (host *hostFunctions) instantiate(ctx context.Context, engine wazero.Runtime) error {
+	builders := map[string]wazero.HostModuleBuilder{
+		hostModule: engine.NewHostModuleBuilder(hostModule).
+			NewFunctionBuilder().WithFunc(hostCall).Export("host-call").
+			NewFunctionBuilder().WithFunc(hostResume).Export("host-resume").
+			NewFunctionBuilder().WithFunc(hostPushAnswer).Export("host-push-answer"),
+	}
+	names := []string{hostModule}
+	if host != nil {
+		seen := map[[2]string]bool{
+			{hostModule, "host-call"}:        true,
+			{hostModule, "host-resume"}:      true,
+			{hostModule, "host-push-answer"}: true,
+		}
+		for _, fn := range host.fns {
+			module := fn.Module
+			if module == "" {
+				module = hostModule
+			}
+			if seen[[2]string{module, fn.Name}] {
+				return fmt.Errorf("trealla: duplicate host function: %s.%s", module, fn.Name)
+			}
+			seen[[2]string{module, fn.Name}] = true
+			builder, ok := builders[module]
+			if !ok {
+				builder = engine.NewHostModuleBuilder(module)
+				builders[module] = builder
+				names = append(names, module)
+			}
+			builders[module] = builder.NewFunctionBuilder().
+				WithGoModuleFunction(hostFunc(fn.Func), fn.Params, fn.Results).
+				Export(fn.Name)
+		}
+	}
+	for _, name := range names {
+		if _, err := builders[name].Instantiate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostFunc finds the interpreter and query calling fn.
+func hostFunc(fn func(context.Context, Prolog, Subquery, api.Module, []uint64)) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		var pl *prolog
+		var subquery uint32
+		subq, ok := ctx.Value(queryContext{}).(*query)
+		if ok {
+			pl = subq.pl
+			subquery = subq.subquery
+			if subquery == 0 {
+				// still starting, see prolog.subquery
+				for spawn, q := range pl.spawning {
+					if q == subq {
+						subquery = pl.indirect(spawn)
+					}
+				}
+			}
+		} else {
+			pl = ctx.Value(prologKey{}).(*prolog)
+		}
+		locked := &lockedProlog{prolog: pl, query: subq}
+		defer locked.kill()
+		fn(ctx, locked, Subquery(subquery), mod, stack)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"io"
 	"iter"
+	"strconv"
+	"strings"
 )
 
 // Predicate is a Prolog predicate implemented in Go.
 // subquery is an opaque number representing the current query.
 // goal is the goal called, which includes the arguments.
+// Use [QueryContext] with pl to get the calling query's context.
 //
 // Return value meaning:
 //   - By default, the term returned will be unified with the goal.
@@ -22,6 +25,12 @@ type Predicate func(pl Prolog, subquery Subquery, goal Term) Term
 // NondetPredicate works similarly to [Predicate], but can create multiple choice points.
 type NondetPredicate func(pl Prolog, subquery Subquery, goal Term) iter.Seq[Term]
 
+// AsyncPredicate works similarly to [Predicate], but runs in its own goroutine.
+// While it runs, the calling query is suspended and other queries can use the interpreter.
+// ctx is canceled if the calling query is canceled or closed before it returns.
+// It must not use the interpreter that called it.
+type AsyncPredicate func(ctx context.Context, subquery Subquery, goal Term) Term
+
 // Subquery is an opaque value representing an in-flight query.
 // It is unique as long as the query is alive, but may be re-used later on.
 type Subquery uint32
@@ -31,55 +40,287 @@ type coroutine struct {
 	stop func()
 }
 
+// asyncCall is an in-flight call to an [AsyncPredicate].
+type asyncCall struct {
+	module Atom
+	result Term
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
 type coroer interface {
 	CoroStart(subq Subquery, seq iter.Seq[Term]) int64
 	CoroNext(subq Subquery, id int64) (Term, bool)
 	CoroStop(subq Subquery, id int64)
 }
 
-func (pl *prolog) Register(ctx context.Context, name string, arity int, proc Predicate) error {
+// RegisterOption is an optional parameter for registering native predicates.
+type RegisterOption func(*registration)
+
+type registration struct {
+	module Atom
+	meta   []Term
+	batch  int
+}
+
+func newRegistration(opts []RegisterOption) registration {
+	r := registration{module: "user"}
+	for _, opt := range opts {
+		opt(&r)
+	}
+	return r
+}
+
+// key returns the key of name/arity in the procs and asyncs maps.
+func (r registration) key(name Atom, arity int) string {
+	return procKey(r.module, piTerm(name, arity).String())
+}
+
+// procKey returns the key of a predicate indicator in the procs and asyncs maps.
+// Predicates in the user module are keyed by their indicator alone.
+func procKey(module Atom, pi string) string {
+	if module == "user" {
+		return pi
+	}
+	return module.String() + ":" + pi
+}
+
+// WithModule registers a predicate in the given module instead of "user".
+// Call it from other modules as module:name(...), or export it with a module declaration.
+func WithModule(module string) RegisterOption {
+	return func(r *registration) {
+		r.module = Atom(module)
+	}
+}
+
+// WithMetaPredicate declares a predicate to be a meta-predicate, as in meta_predicate/1.
+// There is one specifier per argument: an integer from 0 to 9 for goals
+// (called with that many extra arguments), or one of the atoms :, ^, //, ?, +, and -.
+// Goal arguments (0 to 9 and :) reach Go as Module:Goal, so that a goal returned in a call/1 continuation
+// runs in the module it came from. Module is the context module of the calling query:
+// Module for a query written as Module:Goal, otherwise user.
+// Trealla doesn't track the context module of the calling clause,
+// so clauses that pass goals across modules should qualify them.
+// Goals that are already qualified are passed as written.
+func WithMetaPredicate(specs ...Term) RegisterOption {
+	return func(r *registration) {
+		r.meta = specs
+	}
+}
+
+// WithBatchSize makes a predicate registered with RegisterNondet fetch up to n solutions
+// from its iterator per call to Go, instead of one.
+// Solutions are enumerated on the Prolog side, which is much faster for predicates with many solutions.
+// Iterators are still pulled lazily, but may run ahead of the caller's backtracking by up to n-1 solutions,
+// so they must not modify terms after yielding them.
+// Other kinds of predicates ignore this option.
+func WithBatchSize(n int) RegisterOption {
+	return func(r *registration) {
+		r.batch = n
+	}
+}
+
+func (pl *prolog) Register(ctx context.Context, name string, arity int, proc Predicate, opts ...RegisterOption) error {
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
 	if pl.instance == nil {
 		return io.EOF
 	}
-	return pl.register(ctx, name, arity, proc)
+	return pl.register(ctx, name, arity, proc, opts...)
+}
+
+func (pl *prolog) register(ctx context.Context, name string, arity int, proc Predicate, opts ...RegisterOption) error {
+	r := newRegistration(opts)
+	if err := pl.unconsultShim(ctx, Atom(name), arity, r); err != nil {
+		return err
+	}
+	pl.procs[r.key(Atom(name), arity)] = proc
+	return pl.consultShim(ctx, Atom(name), arity, r)
 }
 
-func (pl *prolog) register(ctx context.Context, name string, arity int, proc Predicate) error {
-	functor := Atom(name)
-	pi := piTerm(functor, arity)
-	pl.procs[pi.String()] = proc
+// consultShim defines name/arity as a call to the host.
+// It's dynamic so that it can be abolished by Unregister.
+func (pl *prolog) consultShim(ctx context.Context, functor Atom, arity int, r registration) error {
+	if r.meta != nil && len(r.meta) != arity {
+		return fmt.Errorf("trealla: meta_predicate specifiers for %s don't match arity (%d != %d)",
+			piTerm(functor, arity), len(r.meta), arity)
+	}
 	vars := numbervars(arity)
 	head := functor.Of(vars...)
-	body := Atom(":").Of(Atom("wasm_generic"), Atom("host_rpc").Of(head))
-	clause := fmt.Sprintf(`%s :- %s.`, head.String(), body.String())
-	return pl.consultText(ctx, "user", clause)
+	// goal arguments are passed to the host qualified, see qualifyMeta
+	var body []string
+	args := vars
+	if r.meta != nil {
+		args = make([]Term, arity)
+		for i, spec := range r.meta {
+			if !isGoalSpec(spec) {
+				args[i] = vars[i]
+				continue
+			}
+			q := Variable{Name: "_Q" + strconv.Itoa(i)}
+			body = append(body, qualifyMeta(vars[i].(Variable), q, i))
+			args[i] = q
+		}
+	}
+	// the host sees module:Goal if it's not in user
+	var goal Term = functor.Of(args...)
+	if r.module != "user" {
+		goal = Atom(":").Of(r.module, goal)
+	}
+	body = append(body, Atom(":").Of(Atom("wasm_generic"), Atom("host_rpc").Of(goal)).String())
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ":- dynamic(%s).\n", piTerm(functor, arity).String())
+	if r.meta != nil {
+		fmt.Fprintf(&sb, ":- meta_predicate(%s).\n", functor.Of(r.meta...).String())
+	}
+	fmt.Fprintf(&sb, "%s :- %s.\n", head.String(), strings.Join(body, ", "))
+	return pl.consultText(ctx, string(r.module), sb.String())
 }
 
-func (pl *prolog) RegisterNondet(ctx context.Context, name string, arity int, proc NondetPredicate) error {
+// isGoalSpec reports whether a meta_predicate specifier is for a module-sensitive argument:
+// a goal called with 0 to 9 extra arguments, or :.
+func isGoalSpec(spec Term) bool {
+	switch spec := spec.(type) {
+	case int64:
+		return spec >= 0 && spec <= 9
+	case int:
+		return spec >= 0 && spec <= 9
+	case Atom:
+		return spec == ":"
+	}
+	return false
+}
+
+// qualifyMeta returns a goal that binds q to the goal argument v as Module:Goal,
+// where Module is the calling query's context module (see '$context_module'/1).
+// i numbers the goal's variables. Qualified goals and variables are passed as they are:
+//
+//	(   callable(V), V \= _:_
+//	->  user:'$context_module'(M), Q = M:V
+//	;   Q = V
+//	)
+func qualifyMeta(v, q Variable, i int) string {
+	return fmt.Sprintf("(callable(%[1]s), %[1]s \\= _:_ -> user:'$context_module'(_M%[3]d), %[2]s = _M%[3]d:%[1]s ; %[2]s = %[1]s)",
+		v.Name, q.Name, i)
+}
+
+// unconsultShim removes a previously registered name/arity, if any.
+// It doesn't rely on procs and asyncs, which start empty in an interpreter restored
+// from a snapshot that still has the shims: any dynamic name/arity is removed.
+func (pl *prolog) unconsultShim(ctx context.Context, functor Atom, arity int, r registration) error {
+	key := r.key(functor, arity)
+	// functor(Head, Name, Arity), predicate_property(Module:Head, dynamic) -> Module:abolish(Name/Arity) ; true.
+	head := Variable{Name: "Head"}
+	goal := Atom(";").Of(
+		Atom("->").Of(
+			Atom(",").Of(
+				Atom("functor").Of(head, functor, int64(arity)),
+				Atom("predicate_property").Of(Atom(":").Of(r.module, head), Atom("dynamic")),
+			),
+			Atom(":").Of(r.module, Atom("abolish").Of(piTerm(functor, arity))),
+		),
+		Atom("true"),
+	)
+	if _, err := pl.queryOnce(ctx, goal.String()+"."); err != nil {
+		return fmt.Errorf("trealla: failed to remove predicate %s: %w", key, err)
+	}
+	delete(pl.procs, key)
+	delete(pl.asyncs, key)
+	return nil
+}
+
+func (pl *prolog) RegisterNondet(ctx context.Context, name string, arity int, proc NondetPredicate, opts ...RegisterOption) error {
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
 	if pl.instance == nil {
 		return io.EOF
 	}
-	return pl.registerNondet(ctx, name, arity, proc)
+	return pl.registerNondet(ctx, name, arity, proc, opts...)
 }
 
-func (pl *prolog) registerNondet(ctx context.Context, name string, arity int, proc NondetPredicate) error {
+func (pl *prolog) registerNondet(ctx context.Context, name string, arity int, proc NondetPredicate, opts ...RegisterOption) error {
+	batch := newRegistration(opts).batch
 	shim := func(pl2 Prolog, subquery Subquery, goal Term) Term {
 		plc := pl2.(coroer)
 		seq := proc(pl2, subquery, goal)
 		id := plc.CoroStart(subquery, seq)
-		// call: call_cleanup('$coro_next'(ID), '$coro_stop'(ID))
+		next := Atom("$coro_next").Of(id, goal)
+		if batch > 1 {
+			next = Atom("$coro_next").Of(id, int64(batch), goal)
+		}
+		// call: call_cleanup('$coro_next'(ID, ...), '$coro_stop'(ID))
 		return Atom("call").Of(
 			Atom("call_cleanup").Of(
-				Atom("$coro_next").Of(id, goal),
+				next,
 				Atom("$coro_stop").Of(id),
 			),
 		)
 	}
-	return pl.register(ctx, name, arity, shim)
+	return pl.register(ctx, name, arity, shim, opts...)
+}
+
+func (pl *prolog) RegisterAsync(ctx context.Context, name string, arity int, proc AsyncPredicate, opts ...RegisterOption) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return io.EOF
+	}
+	return pl.registerAsync(ctx, name, arity, proc, opts...)
+}
+
+func (pl *prolog) registerAsync(ctx context.Context, name string, arity int, proc AsyncPredicate, opts ...RegisterOption) error {
+	r := newRegistration(opts)
+	if err := pl.unconsultShim(ctx, Atom(name), arity, r); err != nil {
+		return err
+	}
+	pl.asyncs[r.key(Atom(name), arity)] = proc
+	return pl.consultShim(ctx, Atom(name), arity, r)
+}
+
+func (pl *prolog) Unregister(ctx context.Context, name string, arity int, opts ...RegisterOption) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return io.EOF
+	}
+	return pl.unregister(ctx, name, arity, opts...)
+}
+
+func (pl *prolog) unregister(ctx context.Context, name string, arity int, opts ...RegisterOption) error {
+	r := newRegistration(opts)
+	key := r.key(Atom(name), arity)
+	_, isProc := pl.procs[key]
+	_, isAsync := pl.asyncs[key]
+	if !isProc && !isAsync {
+		return fmt.Errorf("trealla: can't unregister %s: not a registered predicate", key)
+	}
+	return pl.unconsultShim(ctx, Atom(name), arity, r)
+}
+
+func (pl *prolog) Call(ctx context.Context, goal Term, options ...QueryOption) iter.Seq2[Term, error] {
+	return solve(ctx, pl.Query, goal, options)
+}
+
+// solve runs goal using query and yields goal with each answer's substitutions applied.
+func solve(ctx context.Context, query func(context.Context, string, ...QueryOption) Query, goal Term, options []QueryOption) iter.Seq2[Term, error] {
+	return func(yield func(Term, error) bool) {
+		text, err := marshal(goal)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		q := query(ctx, text, options...)
+		defer q.Close()
+		for q.Next(ctx) {
+			if !yield(q.Current().Solution.apply(goal), nil) {
+				return
+			}
+		}
+		if err := q.Err(); err != nil && !IsFailure(err) {
+			yield(nil, err)
+		}
+	}
 }
 
 // '$coro_next'(+ID, ?Goal)
@@ -103,6 +344,48 @@ func sys_coro_next_2(pl Prolog, subquery Subquery, goal Term) Term {
 	)
 }
 
+// '$coro_next'(+ID, +N, ?Goal)
+// Like '$coro_next'/2, but fetches up to N solutions at a time.
+func sys_coro_next_3(pl Prolog, subquery Subquery, goal Term) Term {
+	plc := pl.(coroer)
+	g := goal.(Compound)
+	id, ok := g.Args[0].(int64)
+	if !ok {
+		return throwTerm(domainError("integer", g.Args[0], g.pi()))
+	}
+	n, ok := g.Args[1].(int64)
+	if !ok || n < 1 {
+		return throwTerm(domainError("positive_integer", g.Args[1], g.pi()))
+	}
+	results := make([]Term, 0, n)
+	more := true
+	for int64(len(results)) < n {
+		result, ok := plc.CoroNext(subquery, id)
+		if !ok || result == nil {
+			more = false
+			break
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return Atom("fail")
+	}
+	// call(( wasm_generic:host_rpc_eval(Goal, Result1, [], []) ; ... ; '$coro_next'(ID, N, Goal) ))
+	var alts Term
+	if more {
+		alts = Atom("$coro_next").Of(id, n, g.Args[2])
+	}
+	for i := len(results) - 1; i >= 0; i-- {
+		eval := Atom(":").Of(Atom("wasm_generic"), Atom("host_rpc_eval").Of(results[i], g.Args[2], Atom("[]"), Atom("[]")))
+		if alts == nil {
+			alts = eval
+			continue
+		}
+		alts = Atom(";").Of(eval, alts)
+	}
+	return Atom("call").Of(alts)
+}
+
 // '$coro_stop'(+ID)
 func sys_coro_stop_1(pl Prolog, subquery Subquery, goal Term) Term {
 	plc := pl.(coroer)
@@ -115,6 +398,16 @@ func sys_coro_stop_1(pl Prolog, subquery Subquery, goal Term) Term {
 	return goal
 }
 
+// '$context_module'(-Module)
+// Module is the context module of the calling query: Module for queries of the form Module:Goal, otherwise user.
+func sys_context_module_1(pl Prolog, _ Subquery, goal Term) Term {
+	module := Atom("user")
+	if locked, ok := pl.(*lockedProlog); ok && locked.query != nil {
+		module = locked.query.module
+	}
+	return Atom("$context_module").Of(module)
+}
+
 func (pl *prolog) CoroStart(subq Subquery, seq iter.Seq[Term]) int64 {
 	pl.coron++
 	id := pl.coron
@@ -188,13 +481,16 @@ func hostCall(ctx context.Context, subquery, msgptr, msgsize, reply_pp, replysiz
 	}
 
 	reply := func(str string) error {
-		msg, err := newCString(pl, str)
-		if err != nil {
-			return err
+		return pl.reply(str, reply_pp, replysize_p)
+	}
+
+	// module:Goal for predicates outside of user
+	module := Atom("user")
+	if qualified, ok := msg.(Compound); ok && qualified.Functor == ":" && len(qualified.Args) == 2 {
+		if m, ok := qualified.Args[0].(Atom); ok {
+			module = m
+			msg = qualified.Args[1]
 		}
-		pl.memory.WriteUint32Le(reply_pp, msg.ptr)
-		pl.memory.WriteUint32Le(replysize_p, uint32(msg.size-1))
-		return nil
 	}
 
 	goal, ok := msg.(atomicTerm)
@@ -206,7 +502,18 @@ func hostCall(ctx context.Context, subquery, msgptr, msgsize, reply_pp, replysiz
 		return wasmTrue
 	}
 
-	proc, ok := pl.procs[goal.Indicator()]
+	key := procKey(module, goal.Indicator())
+
+	if async, ok := pl.asyncs[key]; ok {
+		if err := subq.readOutput(); err != nil {
+			panic(err)
+		}
+		subq.callAsync(ctx, async, Subquery(subquery), goal, module)
+		// the query yields, then picks up the result with host_resume
+		return wasmYield
+	}
+
+	proc, ok := pl.procs[key]
 	if !ok {
 		expr := Atom("throw").Of(
 			Atom("error").Of(
@@ -224,10 +531,10 @@ func hostCall(ctx context.Context, subquery, msgptr, msgsize, reply_pp, replysiz
 	}
 	// log.Println("SAVING", subq.stderr.String())
 
-	locked := &lockedProlog{prolog: pl}
+	locked := &lockedProlog{prolog: pl, query: subq}
 	continuation := catch(proc, locked, Subquery(subquery), goal)
 	locked.kill()
-	expr, err := marshal(continuation)
+	expr, err := marshal(qualify(module, continuation))
 	if err != nil {
 		panic(err)
 	}
@@ -262,9 +569,10 @@ func hostPushAnswer(ctx context.Context, subquery, msgptr, msgsize uint32) {
 	}
 	stdout := subq.stdout.String()
 	stderr := subq.stderr.String()
+	truncated := subq.truncated
 	subq.resetOutput()
 
-	ans, err := pl.parse(subq.goal, msg, stdout, stderr)
+	ans, err := pl.parse(subq, msg, stdout, stderr, truncated)
 	if err != nil {
 		subq.setError(err)
 		return
@@ -284,6 +592,17 @@ func catch(pred Predicate, pl Prolog, subq Subquery, goal Term) (result Term) {
 				} else {
 					result = throwTerm(ball)
 				}
+			case error:
+				if pl != nil {
+					result = ThrowError(pl, subq, ball)
+					break
+				}
+				result = throwTerm(
+					Atom("system_error").Of(
+						Atom("panic").Of(ball.Error()),
+						goal.(atomicTerm).pi(),
+					),
+				)
 			default:
 				result = throwTerm(
 					Atom("system_error").Of(
@@ -298,9 +617,57 @@ func catch(pred Predicate, pl Prolog, subq Subquery, goal Term) (result Term) {
 	return
 }
 
-func hostResume(_, _, _ uint32) uint32 {
+func hostResume(ctx context.Context, _, reply_pp, replysize_p uint32) uint32 {
 	// extern int32_t host_resume(int32_t subquery, char **reply, size_t *reply_size);
-	return wasmFalse
+	subq := ctx.Value(queryContext{}).(*query)
+	pl := subq.pl
+
+	call := subq.async
+	if call == nil {
+		return wasmFalse
+	}
+	<-call.done
+	subq.async = nil
+	call.cancel()
+
+	expr, err := marshal(qualify(call.module, call.result))
+	if err != nil {
+		panic(err)
+	}
+	if err := pl.reply(expr, reply_pp, replysize_p); err != nil {
+		panic(err)
+	}
+	return wasmTrue
+}
+
+// qualify returns the result of a predicate in module,
+// which the interpreter unifies with module:Goal unless it's a special form (see [Predicate]).
+func qualify(module Atom, result Term) Term {
+	if module == "user" {
+		return result
+	}
+	switch x := result.(type) {
+	case Atom:
+		if x == "true" || x == "fail" {
+			return result
+		}
+	case Compound:
+		if (x.Functor == "throw" || x.Functor == "call") && len(x.Args) == 1 {
+			return result
+		}
+	}
+	return Atom(":").Of(module, result)
+}
+
+// reply writes a host call's reply to the interpreter.
+func (pl *prolog) reply(str string, reply_pp, replysize_p uint32) error {
+	msg, err := newCString(pl, str)
+	if err != nil {
+		return err
+	}
+	pl.memory.WriteUint32Le(reply_pp, msg.ptr)
+	pl.memory.WriteUint32Le(replysize_p, uint32(msg.size-1))
+	return nil
 }
 
 var (
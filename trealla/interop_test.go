@@ -3,10 +3,13 @@ package trealla
 import (
 	"context"
 	"errors"
+	"fmt"
 	"iter"
 	"log"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestInterop(t *testing.T) {
@@ -137,6 +140,18 @@ func TestInteropNondet(t *testing.T) {
 		t.Fatal(err)
 	}
 	pl.RegisterNondet(ctx, "countdown", 2, pred)
+	batched := func(pl Prolog, subquery Subquery, goal Term) iter.Seq[Term] {
+		return func(yield func(Term) bool) {
+			g := goal.(Compound)
+			n := g.Args[0].(int64)
+			for i := int64(0); i < n; i++ {
+				if !yield(Atom("countdown_batch").Of(n, i)) {
+					break
+				}
+			}
+		}
+	}
+	pl.RegisterNondet(ctx, "countdown_batch", 2, batched, WithBatchSize(3))
 
 	t.Run("success", func(t *testing.T) {
 		q := pl.Query(ctx, "countdown(10, X)")
@@ -156,6 +171,35 @@ func TestInteropNondet(t *testing.T) {
 		}
 	})
 
+	t.Run("batched", func(t *testing.T) {
+		for _, n := range []int64{0, 1, 9, 10} {
+			q := pl.Query(ctx, "countdown_batch(N, X)", WithBind("N", n))
+			var i int64
+			for answer := range q.All(ctx) {
+				if answer.Solution["X"] != i {
+					t.Error("unexpected solution:", answer)
+				}
+				i++
+			}
+			if i != n {
+				t.Errorf("wrong number of solutions for %d: %d", n, i)
+			}
+			if err := q.Err(); err != nil && !IsFailure(err) {
+				t.Error(q.Err())
+			}
+		}
+	})
+
+	t.Run("batched abandoned", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "countdown_batch(100, X), X >= 4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Solution["X"] != int64(4) {
+			t.Error("unexpected solution:", ans)
+		}
+	})
+
 	t.Run("bad arg", func(t *testing.T) {
 		q := pl.Query(ctx, "countdown(foobar, X)")
 		for q.Next(ctx) {
@@ -183,6 +227,676 @@ func TestInteropNondet(t *testing.T) {
 	}
 }
 
+func TestInteropAsync(t *testing.T) {
+	ctx := context.Background()
+	pl, err := New(WithDebugLog(log.Default()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	pl.RegisterAsync(ctx, "slow_double", 2, func(ctx context.Context, _ Subquery, goal Term) Term {
+		g := goal.(Compound)
+		n, ok := g.Args[0].(int64)
+		if !ok {
+			return typeError("integer", g.Args[0], g.pi())
+		}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return systemError(ctx.Err().Error())
+		}
+		return Atom("slow_double").Of(n, n*2)
+	})
+
+	t.Run("other queries run while waiting", func(t *testing.T) {
+		type result struct {
+			ans Answer
+			err error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			ans, err := pl.QueryOnce(ctx, "write(before), slow_double(21, X), write(after).")
+			ch <- result{ans, err}
+		}()
+
+		// the query above is blocked until release
+		for i := 0; i < 3; i++ {
+			ans, err := pl.QueryOnce(ctx, "X is 1 + 1.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x := ans.Solution["X"]; x != int64(2) {
+				t.Error("unexpected value:", x)
+			}
+		}
+
+		release <- struct{}{}
+		got := <-ch
+		if got.err != nil {
+			t.Fatal(got.err)
+		}
+		if x := got.ans.Solution["X"]; x != int64(42) {
+			t.Error("unexpected value:", x)
+		}
+		if got.ans.Stdout != "beforeafter" {
+			t.Error("unexpected output:", got.ans.Stdout)
+		}
+	})
+
+	t.Run("nondet", func(t *testing.T) {
+		go func() {
+			release <- struct{}{}
+			release <- struct{}{}
+		}()
+		q := pl.Query(ctx, "member(N, [1, 2]), slow_double(N, X).")
+		var got []Term
+		for ans := range q.All(ctx) {
+			got = append(got, ans.Solution["X"])
+		}
+		if err := q.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if want := []Term{int64(2), int64(4)}; !reflect.DeepEqual(want, got) {
+			t.Error("unexpected values. want:", want, "got:", got)
+		}
+	})
+
+	t.Run("throw", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "slow_double(foo, X).")
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected throw, got:", err)
+		}
+		want := Atom("error").Of(Atom("type_error").Of(Atom("integer"), Atom("foo")), piTerm("slow_double", 2))
+		if !reflect.DeepEqual(ex.Ball, want) {
+			t.Error("unexpected error. want:", want, "got:", ex.Ball)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := pl.QueryOnce(ctx, "slow_double(1, X).")
+		if !IsCanceled(err) {
+			t.Fatal("expected cancellation, got:", err)
+		}
+		if _, err := pl.QueryOnce(context.Background(), "true."); err != nil {
+			t.Error("interpreter not usable after cancel:", err)
+		}
+	})
+}
+
+func TestQueryContext(t *testing.T) {
+	type key struct{}
+	pl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	pl.Register(ctx, "ctx_value", 1, func(pl Prolog, _ Subquery, goal Term) Term {
+		v, _ := QueryContext(pl).Value(key{}).(string)
+		return Atom("ctx_value").Of(v)
+	})
+	pl.RegisterNondet(ctx, "ctx_values", 1, func(pl Prolog, _ Subquery, goal Term) iter.Seq[Term] {
+		return func(yield func(Term) bool) {
+			for {
+				v, _ := QueryContext(pl).Value(key{}).(string)
+				if !yield(Atom("ctx_values").Of(v)) {
+					return
+				}
+			}
+		}
+	})
+
+	t.Run("det", func(t *testing.T) {
+		ans, err := pl.QueryOnce(context.WithValue(ctx, key{}, "hello"), "ctx_value(X).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := ans.Solution["X"]; x != "hello" {
+			t.Error("unexpected value:", x)
+		}
+	})
+
+	t.Run("nondet", func(t *testing.T) {
+		// the first solution is computed by Query, the rest by Next
+		q := pl.Query(context.WithValue(ctx, key{}, "a"), "ctx_values(X).")
+		defer q.Close()
+		for _, want := range []string{"a", "b", "c"} {
+			if !q.Next(context.WithValue(ctx, key{}, want)) {
+				t.Fatal("expected solution", q.Err())
+			}
+			if x := q.Current().Solution["X"]; x != want {
+				t.Error("unexpected value. want:", want, "got:", x)
+			}
+		}
+	})
+
+	t.Run("not a predicate", func(t *testing.T) {
+		if QueryContext(pl) != context.Background() {
+			t.Error("expected background context")
+		}
+	})
+}
+
+func TestRegisterFunc(t *testing.T) {
+	ctx := context.Background()
+	pl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterFunc(ctx, "add", func(a, b int64) int64 { return a + b }); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterFunc(ctx, "greet", func(ctx context.Context, name string, loud bool) (string, error) {
+		if name == "" {
+			return "", errors.New("no name")
+		}
+		if loud {
+			return "HELLO " + name, nil
+		}
+		return "hello " + name, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterFunc(ctx, "split", func(xs []int) (evens, odds []int) {
+		for _, x := range xs {
+			if x%2 == 0 {
+				evens = append(evens, x)
+			} else {
+				odds = append(odds, x)
+			}
+		}
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterFunc(ctx, "small", func(n int8) bool { return n < 10 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterFunc(ctx, "sqrt", func(x float64) (float64, error) {
+		if x < 0 {
+			return 0, DomainError{Domain: "not_less_than_zero", Culprit: x}
+		}
+		return math.Sqrt(x), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterFunc(ctx, "bad", 42); err == nil {
+		t.Error("expected error registering non-function")
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  Substitution
+		err   Term
+	}{
+		{
+			name:  "add/3",
+			query: "add(1, 2, X).",
+			want:  Substitution{"X": int64(3)},
+		},
+		{
+			name:  "add/3 check",
+			query: "add(1, 2, 3).",
+			want:  Substitution{},
+		},
+		{
+			name:  "greet/3 atom",
+			query: "greet(world, false, X).",
+			want:  Substitution{"X": "hello world"},
+		},
+		{
+			name:  "greet/3 string",
+			query: `greet("world", true, X).`,
+			want:  Substitution{"X": "HELLO world"},
+		},
+		{
+			name:  "split/3",
+			query: "split([1, 2, 3, 4, 5], Evens, Odds).",
+			want:  Substitution{"Evens": []Term{int64(2), int64(4)}, "Odds": []Term{int64(1), int64(3), int64(5)}},
+		},
+		{
+			name:  "small/2",
+			query: "small(3, X).",
+			want:  Substitution{"X": Atom("true")},
+		},
+		{
+			name:  "type error",
+			query: "add(1, foo, X).",
+			err:   Atom("error").Of(Atom("type_error").Of(Atom("integer"), Atom("foo")), piTerm("add", 3)),
+		},
+		{
+			name:  "instantiation error",
+			query: "add(1, _, X).",
+			err:   Atom("error").Of(Atom("instantiation_error"), piTerm("add", 3)),
+		},
+		{
+			name:  "iso error caught",
+			query: "catch(sqrt(-2.25, _), error(domain_error(D, C), _), true).",
+			want:  Substitution{"D": Atom("not_less_than_zero"), "C": -2.25},
+		},
+		{
+			name:  "representation error",
+			query: "small(1000, X).",
+			err:   Atom("error").Of(Atom("representation_error").Of(Atom("int8")), piTerm("small", 2)),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ans, err := pl.QueryOnce(ctx, tc.query)
+			if tc.err != nil {
+				var ex ErrThrow
+				if !errors.As(err, &ex) {
+					t.Fatal("expected throw, got:", err)
+				}
+				if !reflect.DeepEqual(ex.Ball, tc.err) {
+					t.Error("unexpected error. want:", tc.err, "got:", ex.Ball)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ans.Solution, tc.want) {
+				t.Error("unexpected solution. want:", tc.want, "got:", ans.Solution)
+			}
+		})
+	}
+}
+
+type notFoundError struct{ key string }
+
+func (err notFoundError) Error() string { return "not found: " + err.key }
+
+func TestThrowError(t *testing.T) {
+	ctx := context.Background()
+	pl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errNoRows := errors.New("no rows in result set")
+	pl.Register(ctx, "lookup", 2, func(pl Prolog, subquery Subquery, goal Term) Term {
+		key := goal.(Compound).Args[0]
+		switch key {
+		case Atom("missing"):
+			return ThrowError(pl, subquery, fmt.Errorf("lookup: %w", errNoRows))
+		case Atom("panic"):
+			panic(notFoundError{key: "panic"})
+		}
+		return ThrowError(pl, subquery, notFoundError{key: fmt.Sprint(key)})
+	})
+	pl.Register(ctx, "must_be_int", 1, func(pl Prolog, subquery Subquery, goal Term) Term {
+		x := goal.(Compound).Args[0]
+		if _, ok := x.(int64); !ok {
+			return ThrowError(pl, subquery, fmt.Errorf("must_be_int: %w", TypeError{Type: "integer", Culprit: x}))
+		}
+		return goal
+	})
+	pl.RegisterFunc(ctx, "fetch", func(key string) (string, error) {
+		return "", notFoundError{key: key}
+	})
+	// rethrow(:Goal) calls Goal in a nested query and throws its error again.
+	pl.Register(ctx, "rethrow", 1, func(pl Prolog, subquery Subquery, goal Term) Term {
+		for _, err := range pl.Call(ctx, goal.(Compound).Args[0]) {
+			if err != nil {
+				return ThrowError(pl, subquery, err)
+			}
+		}
+		return goal
+	})
+
+	t.Run("errors.Is", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "lookup(missing, _).")
+		if !errors.Is(err, errNoRows) {
+			t.Fatal("expected errNoRows, got:", err)
+		}
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected ErrThrow, got:", err)
+		}
+	})
+
+	for _, query := range []string{"lookup(foo, _).", "lookup(panic, _).", `fetch("foo", _).`, "rethrow(lookup(foo, _))."} {
+		t.Run(query, func(t *testing.T) {
+			_, err := pl.QueryOnce(ctx, query)
+			var nf notFoundError
+			if !errors.As(err, &nf) {
+				t.Fatal("expected notFoundError, got:", err)
+			}
+		})
+	}
+
+	t.Run("caught", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "catch(lookup(foo, _), error(system_error(go_error(_, Msg)), _), true).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := ans.Solution["Msg"]; msg != "not found: foo" {
+			t.Error("unexpected message:", msg)
+		}
+	})
+
+	t.Run("iso error", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "catch(must_be_int(foo), error(type_error(T, C), _), true).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Solution["T"] != Atom("integer") || ans.Solution["C"] != Atom("foo") {
+			t.Error("unexpected solution:", ans.Solution)
+		}
+
+		_, err = pl.QueryOnce(ctx, "must_be_int(foo).")
+		var te TypeError
+		if !errors.As(err, &te) || te.Type != "integer" {
+			t.Error("expected TypeError, got:", err)
+		}
+	})
+
+	t.Run("other query", func(t *testing.T) {
+		q := pl.Query(ctx, "catch(lookup(foo, _), Ball, true).")
+		defer q.Close()
+		if !q.Next(ctx) {
+			t.Fatal(q.Err())
+		}
+		_, err := pl.QueryOnce(ctx, "throw(Ball).", WithBind("Ball", q.Current().Solution["Ball"]))
+		var nf notFoundError
+		if errors.As(err, &nf) {
+			t.Error("another query used the error:", err)
+		}
+	})
+
+	t.Run("prolog ball", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "rethrow(throw(ball)).")
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected ErrThrow, got:", err)
+		}
+		if ex.Ball != Atom("ball") || ex.Unwrap() != nil {
+			t.Error("unexpected error:", ex.Ball, ex.Unwrap())
+		}
+	})
+
+	if leftovers := len(pl.(*prolog).handles); leftovers > 0 {
+		t.Error("handles weren't cleaned up:", leftovers)
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	ctx := context.Background()
+	pl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	double := func(_ Prolog, _ Subquery, goal Term) Term {
+		g := goal.(Compound)
+		n, ok := g.Args[0].(int64)
+		if !ok {
+			return typeError("integer", g.Args[0], g.pi())
+		}
+		return Atom("double").Of(n, n*2)
+	}
+	if err := pl.Register(ctx, "double", 2, double, WithModule("mymod")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Register(ctx, "double", 2, func(_ Prolog, _ Subquery, goal Term) Term {
+		return Atom("double").Of(goal.(Compound).Args[0], "user")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.RegisterNondet(ctx, "digit", 1, func(_ Prolog, _ Subquery, goal Term) iter.Seq[Term] {
+		return func(yield func(Term) bool) {
+			for i := range 3 {
+				if !yield(Atom("digit").Of(i)) {
+					return
+				}
+			}
+		}
+	}, WithModule("mymod")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Register(ctx, "twice", 1, func(_ Prolog, _ Subquery, goal Term) Term {
+		g := goal.(Compound).Args[0]
+		return Atom("call").Of(Atom(",").Of(g, g))
+	}, WithModule("mymod"), WithMetaPredicate(int64(0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.ConsultText(ctx, "other", "hello :- write(hi).\ngo :- mymod:twice(other:hello)."); err != nil {
+		t.Fatal(err)
+	}
+	var twiced Term
+	if err := pl.Register(ctx, "twice", 1, func(_ Prolog, _ Subquery, goal Term) Term {
+		twiced = goal.(Compound).Args[0]
+		return Atom("call").Of(Atom(",").Of(twiced, twiced))
+	}, WithMetaPredicate(int64(0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.ConsultText(ctx, "foo", "local :- write(hey).\ngo :- twice(local).\ngo2 :- mymod:twice(local)."); err != nil {
+		t.Fatal(err)
+	}
+	for _, module := range []string{"a", "b"} {
+		text := fmt.Sprintf("helper :- write(%s).\ngo :- mymod:twice(helper).", module)
+		if err := pl.ConsultText(ctx, module, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("qualified", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "mymod:double(21, X), double(21, Y).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Substitution{"X": int64(42), "Y": "user"}
+		if !reflect.DeepEqual(ans.Solution, want) {
+			t.Error("unexpected solution. want:", want, "got:", ans.Solution)
+		}
+	})
+
+	t.Run("throw", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "mymod:double(x, X).")
+		if !errors.As(err, &ErrThrow{}) {
+			t.Error("expected throw, got:", err)
+		}
+	})
+
+	t.Run("nondet", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "findall(X, mymod:digit(X), Xs).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Term{int64(0), int64(1), int64(2)}; !reflect.DeepEqual(ans.Solution["Xs"], want) {
+			t.Error("unexpected solution. want:", want, "got:", ans.Solution["Xs"])
+		}
+	})
+
+	t.Run("meta_predicate", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "other:go.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Stdout != "hihi" {
+			t.Error("unexpected output:", ans.Stdout)
+		}
+	})
+
+	t.Run("meta_predicate module-local goal", func(t *testing.T) {
+		for _, query := range []string{"foo:go.", "foo:go2."} {
+			ans, err := pl.QueryOnce(ctx, query)
+			if err != nil {
+				t.Fatal(query, err)
+			}
+			if ans.Stdout != "heyhey" {
+				t.Error(query, "unexpected output:", ans.Stdout)
+			}
+		}
+		if want := Atom(":").Of(Atom("foo"), Atom("local")); !reflect.DeepEqual(twiced, want) {
+			t.Error("unexpected goal. want:", want, "got:", twiced)
+		}
+
+		ans, err := pl.QueryOnce(ctx, "twice(write(x)).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Stdout != "xx" {
+			t.Error("unexpected output:", ans.Stdout)
+		}
+	})
+
+	t.Run("meta_predicate same goal in two modules", func(t *testing.T) {
+		for _, module := range []Atom{"a", "b"} {
+			ans, err := pl.QueryOnce(ctx, string(module)+":go.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := string(module + module); ans.Stdout != want {
+				t.Error("unexpected output. want:", want, "got:", ans.Stdout)
+			}
+		}
+	})
+
+	t.Run("bad meta_predicate", func(t *testing.T) {
+		err := pl.Register(ctx, "bad", 2, double, WithMetaPredicate(int64(0)))
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("re-register", func(t *testing.T) {
+		if err := pl.Register(ctx, "double", 2, double); err != nil {
+			t.Fatal(err)
+		}
+		ans, err := pl.QueryOnce(ctx, "findall(X, double(21, X), Xs).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Term{int64(42)}; !reflect.DeepEqual(ans.Solution["Xs"], want) {
+			t.Error("unexpected solution. want:", want, "got:", ans.Solution["Xs"])
+		}
+	})
+
+	t.Run("unregister", func(t *testing.T) {
+		if err := pl.Unregister(ctx, "digit", 1, WithModule("mymod")); err != nil {
+			t.Fatal(err)
+		}
+		_, err := pl.QueryOnce(ctx, "mymod:digit(X).")
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected throw, got:", err)
+		}
+		want := Atom("error").Of(Atom("existence_error").Of(Atom("procedure"), piTerm("digit", 1)), piTerm("digit", 1))
+		if !reflect.DeepEqual(ex.Ball, want) {
+			t.Error("unexpected error. want:", want, "got:", ex.Ball)
+		}
+		if _, ok := pl.(*prolog).procs["mymod:digit/1"]; ok {
+			t.Error("predicate not removed from procs")
+		}
+		if err := pl.Unregister(ctx, "digit", 1, WithModule("mymod")); err == nil {
+			t.Error("expected error unregistering twice")
+		}
+	})
+
+	t.Run("unregister user", func(t *testing.T) {
+		if err := pl.Unregister(ctx, "double", 2); err != nil {
+			t.Fatal(err)
+		}
+		// the one in mymod is still there
+		if _, err := pl.QueryOnce(ctx, "mymod:double(21, 42)."); err != nil {
+			t.Error(err)
+		}
+		if _, err := pl.QueryOnce(ctx, "double(21, X)."); !errors.As(err, &ErrThrow{}) {
+			t.Error("expected throw, got:", err)
+		}
+	})
+}
+
+func TestCall(t *testing.T) {
+	ctx := context.Background()
+	pl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go_foldl(:Goal, +List, +V0, -V)
+	pl.Register(ctx, "go_foldl", 4, func(pl Prolog, _ Subquery, goal Term) Term {
+		g := goal.(Compound)
+		list, ok := g.Args[1].([]Term)
+		if !ok {
+			return typeError("list", g.Args[1], g.pi())
+		}
+		acc := g.Args[2]
+		for _, x := range list {
+			var found bool
+			for sol, err := range pl.Call(ctx, Atom("call").Of(g.Args[0], x, acc, Variable{Name: "Acc"})) {
+				if err != nil {
+					var ex ErrThrow
+					if errors.As(err, &ex) {
+						return throwTerm(ex.Ball)
+					}
+					return systemError(err.Error())
+				}
+				acc = sol.(Compound).Args[3]
+				found = true
+				break
+			}
+			if !found {
+				return Atom("fail")
+			}
+		}
+		return Atom("go_foldl").Of(g.Args[0], g.Args[1], g.Args[2], acc)
+	})
+	if err := pl.ConsultText(ctx, "user", "add(X, Acc0, Acc) :- Acc is Acc0 + X, write(X).\nodd(X, Acc, Acc) :- 1 is X mod 2.\nboom(_, _, _) :- throw(boom)."); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("fold", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "go_foldl(add, [1, 2, 3], 0, Sum).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := ans.Solution["Sum"]; sum != int64(6) {
+			t.Error("unexpected sum:", sum)
+		}
+		if ans.Stdout != "123" {
+			t.Error("unexpected output:", ans.Stdout)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "go_foldl(odd, [1, 2, 3], 0, _).")
+		if !IsFailure(err) {
+			t.Error("expected failure, got:", err)
+		}
+	})
+
+	t.Run("throw", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "go_foldl(boom, [1], 0, _).")
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected throw, got:", err)
+		}
+		if want := Atom("boom"); !reflect.DeepEqual(ex.Ball, want) {
+			t.Error("unexpected error. want:", want, "got:", ex.Ball)
+		}
+	})
+
+	t.Run("top level", func(t *testing.T) {
+		var got []Term
+		for sol, err := range pl.Call(ctx, Atom("member").Of(Variable{Name: "X"}, []Term{int64(1), Atom("two")})) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, sol)
+		}
+		want := []Term{
+			Atom("member").Of(int64(1), []Term{int64(1), Atom("two")}),
+			Atom("member").Of(Atom("two"), []Term{int64(1), Atom("two")}),
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Error("unexpected solutions. want:", want, "got:", got)
+		}
+	})
+}
+
 func BenchmarkInteropNondet(b *testing.B) {
 	pred := func(pl Prolog, subquery Subquery, goal Term) iter.Seq[Term] {
 		return func(yield func(Term) bool) {
@@ -214,3 +928,216 @@ func BenchmarkInteropNondet(b *testing.B) {
 		b.Error("coroutines weren't cleaned up:", leftovers)
 	}
 }
+
+func BenchmarkInteropNondetBatch(b *testing.B) {
+	pred := func(pl Prolog, subquery Subquery, goal Term) iter.Seq[Term] {
+		return func(yield func(Term) bool) {
+			for i := 0; ; i++ {
+				if !yield(Atom("churn").Of(i)) {
+					break
+				}
+			}
+		}
+	}
+	ctx := context.Background()
+	pl, err := New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	pl.RegisterNondet(ctx, "churn", 1, pred, WithBatchSize(64))
+	query := pl.Query(ctx, "churn(X).")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !query.Next(ctx) {
+			b.Fatal("query failed", query.Err())
+		}
+	}
+	if err := query.Close(); err != nil {
+		b.Error("close error:", err)
+	}
+	if leftovers := len(pl.(*prolog).coros); leftovers > 0 {
+		b.Error("coroutines weren't cleaned up:", leftovers)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	ctx := context.Background()
+	pl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type counter struct{ n int64 }
+	// counter_new(-Counter)
+	pl.Register(ctx, "counter_new", 1, func(pl Prolog, subquery Subquery, goal Term) Term {
+		h := NewHandle(pl, subquery, &counter{})
+		return Atom("counter_new").Of(h)
+	})
+	// counter_inc(+Counter, -N)
+	pl.Register(ctx, "counter_inc", 2, func(pl Prolog, _ Subquery, goal Term) Term {
+		g := goal.(Compound)
+		h, err := HandleOf[*counter](g.Args[0])
+		if err != nil {
+			return typeError("handle", g.Args[0], g.pi())
+		}
+		c, ok := h.Value(pl)
+		if !ok {
+			return Atom("throw").Of(Atom("error").Of(Atom("existence_error").Of(Atom("handle"), g.Args[0]), g.pi()))
+		}
+		c.n++
+		return Atom("counter_inc").Of(g.Args[0], c.n)
+	})
+	// counter_once(:Goal) calls Goal once in a nested query.
+	var leaked Prolog
+	pl.Register(ctx, "counter_once", 1, func(pl Prolog, subquery Subquery, goal Term) Term {
+		leaked = pl
+		for sol, err := range pl.Call(ctx, goal.(Compound).Args[0]) {
+			if err != nil {
+				return ThrowError(pl, subquery, err)
+			}
+			return Atom("counter_once").Of(sol)
+		}
+		return Atom("fail")
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "counter_new(C), counter_inc(C, _), counter_inc(C, N).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := ans.Solution["N"]; n != int64(2) {
+			t.Error("unexpected count:", n)
+		}
+		h, err := HandleOf[*counter](ans.Solution["C"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := h.Value(pl); ok {
+			t.Error("handle outlived its query")
+		}
+	})
+
+	t.Run("live query", func(t *testing.T) {
+		q := pl.Query(ctx, "counter_new(C), counter_inc(C, N).")
+		if !q.Next(ctx) {
+			t.Fatal(q.Err())
+		}
+		h, err := HandleOf[*counter](q.Current().Solution["C"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, ok := h.Value(pl)
+		if !ok || c.n != 1 {
+			t.Error("bad handle value:", c, ok)
+		}
+		if _, ok := Handle[string](h).Value(pl); ok {
+			t.Error("handle resolved to the wrong type")
+		}
+		q.Close()
+		if leftovers := len(pl.(*prolog).handles); leftovers > 0 {
+			t.Error("handles weren't cleaned up:", leftovers)
+		}
+	})
+
+	t.Run("nested query", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "counter_new(C), counter_once(counter_inc(C, N)).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := ans.Solution["N"]; n != int64(1) {
+			t.Error("unexpected count:", n)
+		}
+	})
+
+	t.Run("other query", func(t *testing.T) {
+		q := pl.Query(ctx, "counter_new(C).")
+		defer q.Close()
+		if !q.Next(ctx) {
+			t.Fatal(q.Err())
+		}
+		h, err := HandleOf[*counter](q.Current().Solution["C"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pl.QueryOnce(ctx, "counter_inc(C, _).", WithBind("C", h))
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected throw, got:", err)
+		}
+		if c, _ := h.Value(pl); c.n != 0 {
+			t.Error("another query used the handle:", c.n)
+		}
+	})
+
+	t.Run("dead reference", func(t *testing.T) {
+		if _, err := pl.QueryOnce(ctx, "counter_once(true)."); err != nil {
+			t.Fatal(err)
+		}
+		h := NewHandle(leaked, 0, &counter{})
+		if _, ok := h.Value(leaked); ok {
+			t.Error("dead reference created a handle")
+		}
+	})
+
+	t.Run("interpreter handle", func(t *testing.T) {
+		h := NewHandle(pl, 0, &counter{n: 41})
+		ans, err := pl.QueryOnce(ctx, "counter_inc(C, N).", WithBind("C", h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := ans.Solution["N"]; n != int64(42) {
+			t.Error("unexpected count:", n)
+		}
+		h.Release(pl)
+		if _, ok := h.Value(pl); ok {
+			t.Error("handle not released")
+		}
+		if _, ok := pl.(*prolog).handles[h.ID]; ok {
+			t.Error("released handle still stored")
+		}
+	})
+
+	t.Run("release in query", func(t *testing.T) {
+		pl.Register(ctx, "counter_release", 1, func(pl Prolog, _ Subquery, goal Term) Term {
+			h, err := HandleOf[*counter](goal.(Compound).Args[0])
+			if err != nil {
+				return typeError("handle", goal.(Compound).Args[0], goal.(Compound).pi())
+			}
+			h.Release(pl)
+			return goal
+		})
+		// a query can't release another query's handles
+		q := pl.Query(ctx, "counter_new(C).")
+		defer q.Close()
+		if !q.Next(ctx) {
+			t.Fatal(q.Err())
+		}
+		other, err := HandleOf[*counter](q.Current().Solution["C"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pl.QueryOnce(ctx, "counter_release(C).", WithBind("C", other)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := other.Value(pl); !ok {
+			t.Error("another query released the handle")
+		}
+
+		_, err = pl.QueryOnce(ctx, "counter_new(C), counter_release(C), counter_inc(C, _).")
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected throw, got:", err)
+		}
+	})
+
+	t.Run("released", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "counter_inc('$go'(1), _).")
+		var ex ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("expected throw, got:", err)
+		}
+		want := Atom("error").Of(Atom("existence_error").Of(Atom("handle"), Handle[any]{ID: 1}.Term()), piTerm("counter_inc", 2))
+		if !reflect.DeepEqual(ex.Ball, want) {
+			t.Error("unexpected error:", ex.Ball)
+		}
+	})
+}
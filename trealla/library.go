@@ -20,7 +20,9 @@ var builtins = []struct {
 	proc  Predicate
 }{
 	{"$coro_next", 2, sys_coro_next_2},
+	{"$coro_next", 3, sys_coro_next_3},
 	{"$coro_stop", 1, sys_coro_stop_1},
+	{"$context_module", 1, sys_context_module_1},
 	{"crypto_data_hash", 3, crypto_data_hash_3},
 	{"http_consult", 1, http_consult_1},
 	{"http_fetch", 3, http_fetch_3},
@@ -37,7 +39,7 @@ func (pl *prolog) loadBuiltins() error {
 }
 
 // TODO: needs to support forms, headers, etc.
-func http_fetch_3(_ Prolog, _ Subquery, goal Term) Term {
+func http_fetch_3(pl Prolog, _ Subquery, goal Term) Term {
 	cmp, _ := goal.(Compound)
 	result := cmp.Args[1]
 	opts := cmp.Args[2]
@@ -59,7 +61,7 @@ func http_fetch_3(_ Prolog, _ Subquery, goal Term) Term {
 		body = strings.NewReader(bodystr)
 	}
 
-	req, err := http.NewRequest(strings.ToUpper(string(method)), href.String(), body)
+	req, err := http.NewRequestWithContext(QueryContext(pl), strings.ToUpper(string(method)), href.String(), body)
 	if err != nil {
 		return domainError("url", cmp.Args[0], err.Error())
 	}
@@ -98,7 +100,7 @@ func http_fetch_3(_ Prolog, _ Subquery, goal Term) Term {
 	return Atom(cmp.Functor).Of(str, buf.String(), Variable{Name: "_"})
 }
 
-func http_consult_1(_ Prolog, _ Subquery, goal Term) Term {
+func http_consult_1(pl Prolog, _ Subquery, goal Term) Term {
 	cmp, ok := goal.(Compound)
 	if !ok {
 		return typeError("compound", goal, piTerm("http_consult", 1))
@@ -131,8 +133,7 @@ func http_consult_1(_ Prolog, _ Subquery, goal Term) Term {
 		return domainError("url", cmp.Args[0], piTerm("http_consult", 1))
 	}
 
-	// TODO: grab context somehow
-	req, err := http.NewRequest(http.MethodGet, href.String(), nil)
+	req, err := http.NewRequestWithContext(QueryContext(pl), http.MethodGet, href.String(), nil)
 	if err != nil {
 		return domainError("url", cmp.Args[0], err.Error())
 	}
@@ -223,6 +224,14 @@ func permissionError(what Atom, got Term, ctx Term) Compound {
 	return throwTerm(Atom("error").Of(Atom("permission_error").Of(what, got), ctx))
 }
 
+func representationError(what Atom, ctx Term) Compound {
+	return throwTerm(Atom("error").Of(Atom("representation_error").Of(what), ctx))
+}
+
+func instantiationError(ctx Term) Compound {
+	return throwTerm(Atom("error").Of(Atom("instantiation_error"), ctx))
+}
+
 func resourceError(what Atom, ctx Term) Compound {
 	return throwTerm(Atom("error").Of(Atom("resource_error").Of(what), ctx))
 }
@@ -0,0 +1,199 @@
+package trealla
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mountDir is where file systems given to ConsultFS are mounted.
+const mountDir = "/.gofs"
+
+// preopens returns the aliases of the directories the interpreter starts with, in the order they're mounted.
+func (pl *prolog) preopens() []string {
+	aliases := []string{mountDir}
+	for alias := range pl.dirs {
+		aliases = append(aliases, alias)
+	}
+	for alias := range pl.fs {
+		aliases = append(aliases, alias)
+	}
+	slices.Sort(aliases)
+	return slices.Compact(aliases)
+}
+
+// mountLayout returns where the interpreter's file systems are:
+// its preopened directories in order, then the library's mount if it has one.
+// The C library keeps its table of preopened directories in linear memory,
+// so memory copied from another instance is only valid with the same layout.
+func (pl *prolog) mountLayout() []string {
+	layout := pl.preopens()
+	if pl.libfs != nil {
+		layout = append(layout, pl.library)
+	}
+	return layout
+}
+
+// mountFS is an [fs.FS] whose top-level directories are file systems attached at runtime.
+// It lets the interpreter read from an [fs.FS] it wasn't started with.
+type mountFS struct {
+	mu     sync.RWMutex
+	mounts map[string]fs.FS
+	n      int64
+}
+
+func newMountFS() *mountFS {
+	return &mountFS{mounts: make(map[string]fs.FS)}
+}
+
+// attach adds fsys, returning its path in the interpreter and a function that removes it.
+func (m *mountFS) attach(fsys fs.FS) (string, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.n++
+	name := strconv.FormatInt(m.n, 10)
+	m.mounts[name] = fsys
+	return path.Join(mountDir, name), func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.mounts, name)
+	}
+}
+
+// Open implements fs.FS.
+func (m *mountFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if name == "." {
+		names := make([]string, 0, len(m.mounts))
+		for name := range m.mounts {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return &mountRoot{names: names}, nil
+	}
+	first, rest, _ := strings.Cut(name, "/")
+	fsys, ok := m.mounts[first]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if rest == "" {
+		rest = "."
+	}
+	return fsys.Open(rest)
+}
+
+// mountRoot is the root directory of a mountFS.
+type mountRoot struct {
+	names []string
+}
+
+func (d *mountRoot) Stat() (fs.FileInfo, error) { return mountInfo("."), nil }
+func (d *mountRoot) Read([]byte) (int, error)   { return 0, io.EOF }
+func (d *mountRoot) Close() error               { return nil }
+
+func (d *mountRoot) ReadDir(n int) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	for len(d.names) > 0 && (n <= 0 || len(entries) < n) {
+		entries = append(entries, fs.FileInfoToDirEntry(mountInfo(d.names[0])))
+		d.names = d.names[1:]
+	}
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// mountInfo describes a directory in the root of a mountFS.
+type mountInfo string
+
+func (fi mountInfo) Name() string       { return string(fi) }
+func (fi mountInfo) Size() int64        { return 0 }
+func (fi mountInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (fi mountInfo) ModTime() time.Time { return time.Time{} }
+func (fi mountInfo) IsDir() bool        { return true }
+func (fi mountInfo) Sys() any           { return nil }
+
+// libraryFS serves Prolog libraries from a resolver given to [WithLibraryResolver].
+// The interpreter looks for library(foo) in its library directory as foo, then foo.pl, and so on,
+// so only names ending in .pl are resolved.
+// Libraries are read once and kept in memory, because the interpreter opens them more than once.
+type libraryFS struct {
+	resolve func(name string) (io.ReadCloser, error)
+	mu      sync.Mutex
+	cache   map[string][]byte
+}
+
+func newLibraryFS(resolve func(name string) (io.ReadCloser, error)) *libraryFS {
+	return &libraryFS{resolve: resolve, cache: make(map[string][]byte)}
+}
+
+// Open implements fs.FS.
+func (l *libraryFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &mountRoot{}, nil
+	}
+	lib, ok := strings.CutSuffix(name, ".pl")
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	data, err := l.load(lib)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &libraryFile{Reader: bytes.NewReader(data), name: path.Base(name)}, nil
+}
+
+func (l *libraryFS) load(lib string) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if data, ok := l.cache[lib]; ok {
+		return data, nil
+	}
+	rc, err := l.resolve(lib)
+	if err != nil {
+		return nil, err
+	}
+	if rc == nil {
+		return nil, fs.ErrNotExist
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	l.cache[lib] = data
+	return data, nil
+}
+
+// libraryFile is a library read by libraryFS.
+type libraryFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *libraryFile) Stat() (fs.FileInfo, error) { return libraryInfo{f}, nil }
+func (f *libraryFile) Close() error               { return nil }
+
+type libraryInfo struct {
+	f *libraryFile
+}
+
+func (fi libraryInfo) Name() string       { return fi.f.name }
+func (fi libraryInfo) Size() int64        { return fi.f.Size() }
+func (fi libraryInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi libraryInfo) ModTime() time.Time { return time.Time{} }
+func (fi libraryInfo) IsDir() bool        { return false }
+func (fi libraryInfo) Sys() any           { return nil }
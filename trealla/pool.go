@@ -1,8 +1,13 @@
 package trealla
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"runtime"
+	"slices"
 	"sync"
 )
 
@@ -50,24 +55,80 @@ func NewPool(options ...PoolOption) (*Pool, error) {
 
 // WriteTx executes a write transaction against this Pool.
 // Use this when modifying the knowledgebase (assert/retract, consulting files, loading modules, and so on).
+// Write transactions are atomic: if tx returns an error or panics, its changes are rolled back.
+// Queries that tx leaves open stop working when it's rolled back; they must still be closed.
 func (pool *Pool) WriteTx(tx func(Prolog) error) error {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
+	cp := pool.canon.checkpoint()
 	pl := &lockedProlog{prolog: pool.canon}
 	defer pl.kill()
+
+	committed := false
+	defer func() {
+		// tx panicked
+		if !committed {
+			pool.canon.rollback(cp)
+		}
+	}()
 	err := tx(pl)
+	committed = true
+	if err != nil {
+		if rerr := pool.canon.rollback(cp); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
 
 	// Eagerly update the replicas.
 	// This seems to be faster than lazily updating them.
-	if err == nil {
-		for _, child := range pool.children {
-			if err := child.become(pool.canon); err != nil {
-				return err
-			}
+	for _, child := range pool.children {
+		if err := child.become(pool.canon); err != nil {
+			return err
 		}
+		// native predicates registered in tx
+		child.procs = maps.Clone(pool.canon.procs)
+		child.asyncs = maps.Clone(pool.canon.asyncs)
 	}
+	return nil
+}
 
-	return err
+// Register a native Go predicate in every interpreter of the pool. See [Prolog.Register].
+func (pool *Pool) Register(ctx context.Context, name string, arity int, predicate Predicate, options ...RegisterOption) error {
+	return pool.WriteTx(func(pl Prolog) error {
+		return pl.Register(ctx, name, arity, predicate, options...)
+	})
+}
+
+// RegisterNondet registers a native Go nondeterminate predicate in every interpreter of the pool.
+// See [Prolog.RegisterNondet].
+func (pool *Pool) RegisterNondet(ctx context.Context, name string, arity int, predicate NondetPredicate, options ...RegisterOption) error {
+	return pool.WriteTx(func(pl Prolog) error {
+		return pl.RegisterNondet(ctx, name, arity, predicate, options...)
+	})
+}
+
+// RegisterAsync registers a native Go predicate that runs in the background in every interpreter of the pool.
+// See [Prolog.RegisterAsync].
+func (pool *Pool) RegisterAsync(ctx context.Context, name string, arity int, predicate AsyncPredicate, options ...RegisterOption) error {
+	return pool.WriteTx(func(pl Prolog) error {
+		return pl.RegisterAsync(ctx, name, arity, predicate, options...)
+	})
+}
+
+// RegisterFunc registers a Go function as a predicate in every interpreter of the pool.
+// See [Prolog.RegisterFunc].
+func (pool *Pool) RegisterFunc(ctx context.Context, name string, fn any, options ...RegisterOption) error {
+	return pool.WriteTx(func(pl Prolog) error {
+		return pl.RegisterFunc(ctx, name, fn, options...)
+	})
+}
+
+// Unregister removes a native Go predicate from every interpreter of the pool. See [Prolog.Unregister].
+func (pool *Pool) Unregister(ctx context.Context, name string, arity int, options ...RegisterOption) error {
+	return pool.WriteTx(func(pl Prolog) error {
+		return pl.Unregister(ctx, name, arity, options...)
+	})
 }
 
 // ReadTx executes a read transaction against this Pool.
@@ -93,6 +154,87 @@ func (pool *Pool) Stats() Stats {
 	return child.Stats()
 }
 
+// Watch starts watching the files consulted in write transactions, reloading them when they change.
+// Reloads are applied with WriteTx, so readers never see a partially loaded file.
+// See [Watcher].
+func (pool *Pool) Watch(ctx context.Context, options ...WatchOption) *Watcher {
+	return newWatcher(ctx, pool, options)
+}
+
+func (pool *Pool) consulted() []string {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return pool.canon.consulted()
+}
+
+func (pool *Pool) stat(name string) (fs.FileInfo, error) {
+	return pool.canon.stat(name)
+}
+
+func (pool *Pool) reload(ctx context.Context, files []string) error {
+	return pool.WriteTx(func(pl Prolog) error {
+		return pl.(reloader).reload(ctx, files)
+	})
+}
+
+// checkpoint is the state of an interpreter that a failed write transaction rolls back to.
+type checkpoint struct {
+	memory   []byte
+	procs    map[string]Predicate
+	asyncs   map[string]AsyncPredicate
+	coros    map[int64]coroutine
+	handles  map[int64]handleValue
+	sources  []string
+	running  map[uint32]*query
+	spawning map[uint32]*query
+}
+
+func (pl *prolog) checkpoint() checkpoint {
+	memory, _ := pl.memory.Read(0, pl.memory.Size())
+	return checkpoint{
+		memory:   slices.Clone(memory),
+		procs:    maps.Clone(pl.procs),
+		asyncs:   maps.Clone(pl.asyncs),
+		coros:    maps.Clone(pl.coros),
+		handles:  maps.Clone(pl.handles),
+		sources:  slices.Clone(pl.sources),
+		running:  maps.Clone(pl.running),
+		spawning: maps.Clone(pl.spawning),
+	}
+}
+
+// rollback restores pl to cp. Queries started since cp are forgotten:
+// they fail with an error, and closing them doesn't touch the restored memory.
+// Coroutines started since cp are stopped. Handle and coroutine IDs aren't reused.
+func (pl *prolog) rollback(cp checkpoint) error {
+	for ptr, q := range pl.running {
+		if cp.running[ptr] != q {
+			q.forget()
+		}
+	}
+	for ptr, q := range pl.spawning {
+		if cp.spawning[ptr] != q {
+			q.forget()
+		}
+	}
+	for id, coro := range pl.coros {
+		if _, ok := cp.coros[id]; !ok {
+			coro.stop()
+		}
+	}
+	if err := pl.restore(cp.memory); err != nil {
+		return err
+	}
+	pl.procs = cp.procs
+	pl.asyncs = cp.asyncs
+	pl.coros = cp.coros
+	pl.handles = cp.handles
+	pl.sources = cp.sources
+	pl.running = cp.running
+	pl.spawning = cp.spawning
+	return nil
+}
+
 func (pool *Pool) spawn() (*prolog, error) {
 	return pool.canon.clone()
 }
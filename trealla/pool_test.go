@@ -2,9 +2,15 @@ package trealla
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 const concurrency = 100
@@ -40,6 +46,259 @@ func TestPool(t *testing.T) {
 	wg.Wait()
 }
 
+func TestPoolRegister(t *testing.T) {
+	ctx := context.Background()
+	pool, err := NewPool(WithPoolSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pool.WriteTx(func(pl Prolog) error {
+		return pl.Register(ctx, "in_tx", 1, func(_ Prolog, _ Subquery, goal Term) Term {
+			return Atom("in_tx").Of(int64(1))
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.RegisterFunc(ctx, "double", func(x int64) int64 { return x * 2 }); err != nil {
+		t.Fatal(err)
+	}
+	err = pool.RegisterNondet(ctx, "two", 1, func(_ Prolog, _ Subquery, goal Term) iter.Seq[Term] {
+		return func(yield func(Term) bool) {
+			_ = yield(Atom("two").Of(int64(1))) && yield(Atom("two").Of(int64(2)))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough reads to use every replica
+	var wg sync.WaitGroup
+	for range 4 * len(pool.children) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := pool.ReadTx(func(pl Prolog) error {
+				ans, err := pl.QueryOnce(ctx, "in_tx(X), double(X, Y), findall(Z, two(Z), Zs).")
+				if err != nil {
+					return err
+				}
+				if y := ans.Solution["Y"]; y != int64(2) {
+					t.Error("bad solution:", ans.Solution)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := pool.Unregister(ctx, "double", 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, child := range pool.children {
+		if _, ok := child.procs["double/2"]; ok {
+			t.Error("predicate still registered in replica")
+		}
+	}
+}
+
+func TestPoolWriteTxRollback(t *testing.T) {
+	ctx := context.Background()
+	pool, err := NewPool(WithPoolSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func() any {
+		t.Helper()
+		var n any
+		err := pool.ReadTx(func(pl Prolog) error {
+			ans, err := pl.QueryOnce(ctx, "findall(X, fact(X), Xs), length(Xs, N).")
+			n = ans.Solution["N"]
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	assert := func(pl Prolog, n int) {
+		t.Helper()
+		if _, err := pl.QueryOnce(ctx, fmt.Sprintf("assertz(fact(%d)).", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pool.WriteTx(func(pl Prolog) error {
+		if err := pl.ConsultText(ctx, "user", ":- dynamic(fact/1)."); err != nil {
+			return err
+		}
+		assert(pl, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		boom := errors.New("boom")
+		err := pool.WriteTx(func(pl Prolog) error {
+			assert(pl, 2)
+			if err := pl.Register(ctx, "native", 0, func(_ Prolog, _ Subquery, goal Term) Term { return goal }); err != nil {
+				return err
+			}
+			return boom
+		})
+		if !errors.Is(err, boom) {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, ok := pool.canon.procs["native/0"]; ok {
+			t.Error("native predicate not rolled back")
+		}
+	})
+
+	t.Run("leaked query", func(t *testing.T) {
+		boom := errors.New("boom")
+		var leaked Query
+		err := pool.WriteTx(func(pl Prolog) error {
+			assert(pl, 5)
+			leaked = pl.Query(ctx, "between(1, 3, X), atom_length(abc, _).")
+			if !leaked.Next(ctx) {
+				t.Fatal(leaked.Err())
+			}
+			return boom
+		})
+		if !errors.Is(err, boom) {
+			t.Fatal("unexpected error:", err)
+		}
+		if leaked.Next(ctx) {
+			t.Error("rolled back query still running")
+		}
+		if err := leaked.Err(); err == nil {
+			t.Error("expected error from rolled back query")
+		}
+		// the query's memory was rolled back and may be reused
+		err = pool.WriteTx(func(pl Prolog) error {
+			q := pl.Query(ctx, "between(1, 3, X), atom_length(abc, _).")
+			defer q.Close()
+			if !q.Next(ctx) {
+				return q.Err()
+			}
+			if err := leaked.Close(); err != nil {
+				return err
+			}
+			if sub := q.(*query).subquery; pool.canon.running[sub] != q {
+				t.Error("closing a rolled back query forgot another one")
+			}
+			var xs []Term
+			for q.Next(ctx) {
+				xs = append(xs, q.Current().Solution["X"])
+			}
+			if len(xs) != 2 {
+				t.Error("query broken by closing a rolled back one:", xs, q.Err())
+			}
+			return q.Err()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(); n != int64(1) {
+			t.Error("wrong number of facts. want: 1 got:", n)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic")
+			}
+		}()
+		pool.WriteTx(func(pl Prolog) error {
+			assert(pl, 3)
+			panic("boom")
+		})
+	})
+
+	// the next write must not publish the failed ones
+	err = pool.WriteTx(func(pl Prolog) error {
+		assert(pl, 4)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != int64(2) {
+		t.Error("wrong number of facts. want: 2 got:", n)
+	}
+}
+
+func TestPoolWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.pl")
+	write := func(text string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	pool, err := NewPool(WithPoolSize(2), WithPoolPrologOption(WithMapDir("/rules", dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := func() any {
+		t.Helper()
+		var x any
+		err := pool.ReadTx(func(pl Prolog) error {
+			ans, err := pl.QueryOnce(ctx, "rule(X).")
+			x = ans.Solution["X"]
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return x
+	}
+
+	now := time.Now()
+	write("rule(1).\n", now)
+	err = pool.WriteTx(func(pl Prolog) error {
+		return pl.Consult(ctx, "/rules/rules.pl")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pool.Watch(ctx, WithWatchInterval(time.Hour))
+	defer w.Close()
+
+	write("rule(2).\n", now.Add(time.Second))
+	if err := w.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := rule(); got != int64(2) {
+		t.Error("not reloaded. got:", got)
+	}
+
+	write("rule(3).\nrule(4) :- .\n", now.Add(2*time.Second))
+	if err := w.Poll(ctx); err == nil {
+		t.Error("expected error")
+	}
+	if got := rule(); got != int64(2) {
+		t.Error("previous version not kept. got:", got)
+	}
+	// changes are only reloaded once
+	if err := w.Poll(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
 func BenchmarkPool4(b *testing.B) {
 	benchmarkPool(b, 4)
 }
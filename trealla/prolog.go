@@ -5,12 +5,16 @@ package trealla
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
 	"log"
 	"maps"
+	"math"
 	"runtime"
+	"slices"
 	"sync"
 
 	"github.com/tetratelabs/wazero"
@@ -26,17 +30,52 @@ type Prolog interface {
 	// QueryOnce executes a query, retrieving a single answer and ignoring others.
 	QueryOnce(ctx context.Context, query string, options ...QueryOption) (Answer, error)
 	// Consult loads a Prolog file with the given path.
-	Consult(ctx context.Context, filename string) error
+	// If the interpreter reports errors such as syntax errors, it returns a [ConsultError].
+	// Use [WithDiagnostics] to see warnings as well.
+	Consult(ctx context.Context, filename string, options ...ConsultOption) error
 	// ConsultText loads Prolog text into module. Use "user" for the global module.
-	ConsultText(ctx context.Context, module string, text string) error
+	// If the interpreter reports errors such as syntax errors, it returns a [ConsultError].
+	// Use [WithDiagnostics] to see warnings as well.
+	ConsultText(ctx context.Context, module string, text string, options ...ConsultOption) error
+	// ConsultFS loads the Prolog file name from fsys, such as an [embed.FS].
+	// Relative paths in its ensure_loaded/1 and use_module/1 directives
+	// are resolved against the root of fsys, and include/1 against the including file.
+	// If the interpreter reports errors such as syntax errors, it returns a [ConsultError].
+	ConsultFS(ctx context.Context, fsys fs.FS, name string, options ...ConsultOption) error
+	// ConsultReader loads Prolog text from r into module, a chunk of clauses at a time,
+	// which avoids holding large generated programs in memory all at once.
+	// If the interpreter reports errors such as syntax errors, it returns a [ConsultError].
+	ConsultReader(ctx context.Context, module string, r io.Reader, options ...ConsultOption) error
 	// Register a native Go predicate.
 	// NOTE: this is *experimental* and its API will likely change.
-	Register(ctx context.Context, name string, arity int, predicate Predicate) error
+	Register(ctx context.Context, name string, arity int, predicate Predicate, options ...RegisterOption) error
 	// Register a native Go nondeterminate predicate.
 	// By returning a sequence of terms, a [NondetPredicate] can create multiple choice points.
-	RegisterNondet(ctx context.Context, name string, arity int, predicate NondetPredicate) error
+	RegisterNondet(ctx context.Context, name string, arity int, predicate NondetPredicate, options ...RegisterOption) error
+	// Register a native Go predicate that runs in the background.
+	// While an [AsyncPredicate] runs, its query is suspended and other queries can run,
+	// so it is suitable for slow operations such as network calls.
+	RegisterAsync(ctx context.Context, name string, arity int, predicate AsyncPredicate, options ...RegisterOption) error
+	// RegisterFunc registers a Go function as the predicate name/N.
+	// Its parameters are the predicate's first arguments and its results are unified with the rest,
+	// so func(a, b int64) int64 becomes name/3. fn may take a leading [context.Context],
+	// which receives the query's context, and may return a trailing error, which is thrown like [ThrowError].
+	// Arguments are converted like [Substitution.Scan]; bool is the atom true or false.
+	RegisterFunc(ctx context.Context, name string, fn any, options ...RegisterOption) error
+	// Unregister removes a native Go predicate registered by one of the Register methods.
+	// Pass [WithModule] if it was registered in a module.
+	Unregister(ctx context.Context, name string, arity int, options ...RegisterOption) error
+	// Call runs goal, returning an iterator over its solutions: goal with its variables bound.
+	// Native predicates can use this with the [Prolog] they are given to call back into Prolog,
+	// for example to call a closure argument G as call(G, X, Y).
+	// Unlike a call/1 continuation, this lets the predicate inspect the solutions.
+	Call(ctx context.Context, goal Term, options ...QueryOption) iter.Seq2[Term, error]
 	// Clone creates a new clone of this interpreter.
 	Clone() (Prolog, error)
+	// Snapshot returns an image of this interpreter that [NewFromSnapshot] can restore,
+	// for example to consult a large program once at build time.
+	// Go-side state, such as native predicates and handles, is not included.
+	Snapshot() ([]byte, error)
 	// Close destroys the Prolog instance.
 	// If this isn't called and the Prolog variable goes out of scope, runtime finalizers will try to free the memory.
 	Close()
@@ -55,33 +94,54 @@ type prolog struct {
 
 	ptr uint32
 	// from stdlib
-	realloc wasmFunc
-	free    wasmFunc
+	realloc *wasmFunc
+	free    *wasmFunc
 	// from trealla.h
-	pl_consult       wasmFunc
-	pl_capture       wasmFunc
-	pl_capture_read  wasmFunc
-	pl_capture_reset wasmFunc
-	pl_capture_free  wasmFunc
-	pl_query         wasmFunc
-	pl_redo          wasmFunc
-	pl_done          wasmFunc
-
-	procs map[string]Predicate
-	coros map[int64]coroutine
-	coron int64
+	pl_eval          *wasmFunc
+	pl_capture       *wasmFunc
+	pl_capture_read  *wasmFunc
+	pl_capture_reset *wasmFunc
+	pl_capture_free  *wasmFunc
+	pl_query         *wasmFunc
+	pl_redo          *wasmFunc
+	pl_done          *wasmFunc
+	pl_yield_at      *wasmFunc
+	query_did_yield  *wasmFunc
+
+	procs  map[string]Predicate
+	asyncs map[string]AsyncPredicate
+	coros  map[int64]coroutine
+	coron  int64
+
+	handles map[int64]handleValue
+	handlen int64
 
 	dirs    map[string]string
 	fs      map[string]fs.FS
+	sources []string
 	library string
+	libfs   func(name string) (io.ReadCloser, error)
 	trace   bool
 	quiet   bool
 	max     int
+	memmax  int
+	wasm    []byte
+	hash    [sha256.Size]byte
+	rtcfg   wazero.RuntimeConfig
+	host    *hostFunctions
 
 	stdout *log.Logger
 	stderr *log.Logger
 	debug  *log.Logger
 
+	stdoutw io.Writer
+	stderrw io.Writer
+
+	stdin io.Reader
+	input *inputReader
+
+	mounts *mountFS
+
 	mu *sync.Mutex
 }
 
@@ -89,11 +149,18 @@ type prologKey struct{}
 
 // New creates a new Prolog interpreter.
 func New(opts ...Option) (Prolog, error) {
+	pl := newProlog(opts)
+	return pl, pl.init(nil, nil)
+}
+
+func newProlog(opts []Option) *prolog {
 	pl := &prolog{
 		running:  make(map[uint32]*query),
 		spawning: make(map[uint32]*query),
 		procs:    make(map[string]Predicate),
+		asyncs:   make(map[string]AsyncPredicate),
 		coros:    make(map[int64]coroutine),
+		handles:  make(map[int64]handleValue),
 		mu:       new(sync.Mutex),
 		max:      defaultConcurrency,
 	}
@@ -103,7 +170,10 @@ func New(opts ...Option) (Prolog, error) {
 	if pl.max > 0 {
 		pl.limiter = make(chan struct{}, pl.max)
 	}
-	return pl, pl.init(nil)
+	if pl.wasm == nil {
+		pl.wasm, pl.hash = tplWASM, wasmHash()
+	}
+	return pl
 }
 
 func (pl *prolog) argv() []string {
@@ -120,14 +190,41 @@ func (pl *prolog) argv() []string {
 	return args
 }
 
-func (pl *prolog) init(parent *prolog) error {
+// init starts the interpreter: a new one, a clone of parent, or one restored from snap.
+func (pl *prolog) init(parent *prolog, snap *snapshot) error {
+	if parent != nil {
+		pl.memmax = parent.memmax
+		pl.wasm = parent.wasm
+		pl.hash = parent.hash
+		pl.rtcfg = parent.rtcfg
+		pl.host = parent.host
+		pl.dirs = parent.dirs
+		pl.fs = parent.fs
+		pl.libfs = parent.libfs
+	}
+
+	pl.mounts = newMountFS()
+	if pl.libfs != nil {
+		// attached first, so clones get the same path
+		pl.library, _ = pl.mounts.attach(newLibraryFS(pl.libfs))
+	}
+
+	layout := pl.mountLayout()
+	if snap != nil && !slices.Equal(snap.layout, layout) {
+		return fmt.Errorf("trealla: snapshot was made with different mounts: %q, not %q", snap.layout, layout)
+	}
+
 	argv := pl.argv()
 	fs := wazero.NewFSConfig()
-	for alias, dir := range pl.dirs {
-		fs = fs.WithDirMount(dir, alias)
-	}
-	for alias, fsys := range pl.fs {
-		fs = fs.WithFSMount(fsys, alias)
+	// mounted in a fixed order, so that clones and snapshots agree on their file descriptors
+	for _, alias := range pl.preopens() {
+		if alias == mountDir {
+			fs = fs.WithFSMount(pl.mounts, mountDir)
+		} else if fsys, ok := pl.fs[alias]; ok {
+			fs = fs.WithFSMount(fsys, alias)
+		} else {
+			fs = fs.WithDirMount(pl.dirs[alias], alias)
+		}
 	}
 
 	cfg := wazero.NewModuleConfig().WithName("").WithArgs(argv...).WithFSConfig(fs).
@@ -136,13 +233,27 @@ func (pl *prolog) init(parent *prolog) error {
 		// WithStdout(os.Stdout).WithStderr(os.Stderr). // for debugging output capture
 		WithRandSource(rand.Reader)
 
+	// stdin is EOF until initialization is done
+	// (otherwise the interpreter tries to consume it on startup)
+	pl.input = new(inputReader)
+	cfg = cfg.WithStdin(pl.input)
+
 	// run once to initialize global interpreter
-	if parent != nil {
+	if parent != nil || snap != nil {
 		cfg = cfg.WithStartFunctions()
 	}
 
+	key := runtimeKey{cfg: pl.rtcfg, hash: pl.hash, host: pl.host}
+	if pages := pl.memoryPages(); pages < maxPages {
+		key.pages = uint32(pages)
+	}
+	engine, module, err := loadRuntime(key, pl.wasm)
+	if err != nil {
+		return fmt.Errorf("trealla: failed to compile interpreter: %w", err)
+	}
+
 	pl.ctx = context.WithValue(context.Background(), prologKey{}, pl)
-	instance, err := wasmEngine.InstantiateModule(pl.ctx, wasmModule, cfg)
+	instance, err := engine.InstantiateModule(pl.ctx, module, cfg)
 	if err != nil {
 		return err
 	}
@@ -199,12 +310,22 @@ func (pl *prolog) init(parent *prolog) error {
 		return err
 	}
 
+	pl.pl_yield_at, err = pl.function("pl_yield_at")
+	if err != nil {
+		return err
+	}
+
+	pl.query_did_yield, err = pl.function("query_did_yield")
+	if err != nil {
+		return err
+	}
+
 	// pl.get_error, err = pl.function("get_error")
 	// if err != nil {
 	// 	return err
 	// }
 
-	pl.pl_consult, err = pl.function("pl_consult")
+	pl.pl_eval, err = pl.function("pl_eval")
 	if err != nil {
 		return err
 	}
@@ -219,14 +340,18 @@ func (pl *prolog) init(parent *prolog) error {
 		pl.spawning = make(map[uint32]*query)
 
 		pl.procs = maps.Clone(parent.procs)
+		pl.asyncs = maps.Clone(parent.asyncs)
 		pl.coros = make(map[int64]coroutine) // TODO: copy over? probably not
+		pl.handles = make(map[int64]handleValue)
 
-		pl.dirs = parent.dirs
-		pl.fs = parent.fs
+		pl.sources = slices.Clone(parent.sources)
 		pl.library = parent.library
 		pl.quiet = parent.quiet
 		pl.trace = parent.trace
 		pl.debug = parent.debug
+		pl.stdoutw = parent.stdoutw
+		pl.stderrw = parent.stderrw
+		pl.stdin = parent.stdin
 		if parent.max > 0 {
 			pl.max = parent.max
 			pl.limiter = make(chan struct{}, pl.max)
@@ -251,11 +376,25 @@ func (pl *prolog) init(parent *prolog) error {
 			}
 		}
 
+		pl.input.fallback = pl.stdin
 		return nil
 	}
 
 	runtime.SetFinalizer(pl, (*prolog).Close)
 
+	if snap != nil {
+		pl.ptr = snap.ptr
+		if err := pl.restore(snap.memory); err != nil {
+			return err
+		}
+		// builtins are already defined in Prolog
+		for _, predicate := range builtins {
+			pl.procs[newRegistration(nil).key(Atom(predicate.name), predicate.arity)] = predicate.proc
+		}
+		pl.input.fallback = pl.stdin
+		return nil
+	}
+
 	pl_global, err := pl.function("pl_global")
 	if err != nil {
 		return err
@@ -275,6 +414,12 @@ func (pl *prolog) init(parent *prolog) error {
 		return fmt.Errorf("trealla: failed to load builtins: %w", err)
 	}
 
+	// clear the end of file left over from startup so queries can read stdin
+	if _, err := pl.queryOnce(context.Background(), "get_char(user_input, _)."); err != nil {
+		return fmt.Errorf("trealla: failed to reset stdin: %w", err)
+	}
+	pl.input.fallback = pl.stdin
+
 	return nil
 }
 
@@ -286,30 +431,36 @@ func (pl *prolog) Clone() (Prolog, error) {
 
 func (pl *prolog) clone() (*prolog, error) {
 	clone := new(prolog)
-	err := clone.init(pl)
+	err := clone.init(pl, nil)
 	return clone, err
 }
 
 func (pl *prolog) become(parent *prolog) error {
-	mySize, _ := pl.memory.Grow(0)
-	parentSize, _ := parent.memory.Grow(0)
-	if parentSize > mySize {
-		if _, ok := pl.memory.Grow(parentSize - mySize); !ok {
-			panic("trealla: failed to become")
+	parentBuffer, _ := parent.memory.Read(0, parent.memory.Size())
+	if err := pl.restore(parentBuffer); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// restore overwrites the interpreter's memory with a copy of memory.
+func (pl *prolog) restore(memory []byte) error {
+	if size := uint32(len(memory)); size > pl.memory.Size() {
+		if _, ok := pl.memory.Grow((size - pl.memory.Size()) / pageSize); !ok {
+			return fmt.Errorf("trealla: failed to grow memory to %d bytes", size)
 		}
 	}
 	myBuffer, _ := pl.memory.Read(0, pl.memory.Size())
-	parentBuffer, _ := parent.memory.Read(0, parent.memory.Size())
-	copy(myBuffer, parentBuffer)
+	copy(myBuffer, memory)
 	return nil
 }
 
-func (pl *prolog) function(symbol string) (wasmFunc, error) {
+func (pl *prolog) function(symbol string) (*wasmFunc, error) {
 	export := pl.instance.ExportedFunction(symbol)
 	if export == nil {
 		return nil, errUnexported(symbol)
 	}
-	return export, nil
+	return &wasmFunc{fn: export, module: pl.instance, name: symbol}, nil
 }
 
 func (pl *prolog) alloc(size uint32) (uint32, error) {
@@ -356,49 +507,49 @@ func (pl *prolog) Close() {
 	pl.memory = nil
 }
 
-func (pl *prolog) ConsultText(ctx context.Context, module, text string) error {
+func (pl *prolog) ConsultText(ctx context.Context, module, text string, options ...ConsultOption) error {
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
 	if pl.instance == nil {
 		return io.EOF
 	}
-	return pl.consultText(ctx, module, text)
+	return pl.consultText(ctx, module, text, options...)
 }
 
-func (pl *prolog) consultText(ctx context.Context, module, text string) error {
+func (pl *prolog) consultText(ctx context.Context, module, text string, options ...ConsultOption) error {
 	// load_text(Text, [module(Module)]).
 	goal := Atom("load_text").Of(text, []Term{Atom("module").Of(Atom(module))})
-	_, err := pl.queryOnce(ctx, goal.String())
+	ans, err := pl.queryOnce(ctx, goal.String())
 	if err != nil {
-		err = fmt.Errorf("trealla: consult text failed: %w", err)
+		return fmt.Errorf("trealla: consult text failed: %w", err)
 	}
-	return err
+	c := newConsultation("", options)
+	c.check(ans, 1)
+	return c.err()
 }
 
-func (pl *prolog) Consult(_ context.Context, filename string) error {
+func (pl *prolog) Consult(ctx context.Context, filename string, options ...ConsultOption) error {
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
 	if pl.instance == nil {
 		return io.EOF
 	}
-	return pl.consult(filename)
+	return pl.consult(ctx, filename, options...)
 }
 
-func (pl *prolog) consult(filename string) error {
-	fstr, err := newCString(pl, filename)
-	if err != nil {
-		return err
-	}
-	defer fstr.free(pl)
-
-	ret, err := pl.pl_consult.Call(pl.ctx, uint64(pl.ptr), uint64(fstr.ptr))
+func (pl *prolog) consult(ctx context.Context, filename string, options ...ConsultOption) error {
+	// consult(Filename).
+	goal := Atom("consult").Of(Atom(filename))
+	ans, err := pl.queryOnce(ctx, goal.String())
 	if err != nil {
-		return err
+		return fmt.Errorf("trealla: failed to consult file: %s: %w", filename, err)
 	}
-	if uint32(ret[0]) == 0 {
-		return fmt.Errorf("trealla: failed to consult file: %s", filename)
+	if !slices.Contains(pl.sources, filename) {
+		pl.sources = append(pl.sources, filename)
 	}
-	return nil
+	c := newConsultation(filename, options)
+	c.check(ans, 0)
+	return c.err()
 }
 
 func (pl *prolog) indirect(ptr uint32) uint32 {
@@ -410,8 +561,13 @@ func (pl *prolog) indirect(ptr uint32) uint32 {
 	return v
 }
 
+// Stats is diagnostic information about an interpreter.
 type Stats struct {
+	// MemorySize is the current size of the interpreter's memory in bytes.
 	MemorySize int
+	// MemoryLimit is the maximum size the interpreter's memory can grow to in bytes.
+	// See [WithMemoryLimit].
+	MemoryLimit int
 }
 
 func (pl *prolog) Stats() Stats {
@@ -426,10 +582,25 @@ func (pl *prolog) stats() Stats {
 	}
 	size, _ := pl.memory.Grow(0)
 	return Stats{
-		MemorySize: int(size) * pageSize,
+		MemorySize:  clampInt(uint64(size) * pageSize),
+		MemoryLimit: clampInt(uint64(pl.memoryPages()) * pageSize),
 	}
 }
 
+// memoryPages returns the most pages the interpreter's memory can grow to.
+func (pl *prolog) memoryPages() int {
+	if pl.memmax <= 0 || pl.memmax/pageSize >= maxPages {
+		return maxPages
+	}
+	// a limit under a page still limits
+	return max(pl.memmax/pageSize, 1)
+}
+
+// clampInt converts n to an int, saturating on 32-bit platforms where 4GB doesn't fit.
+func clampInt(n uint64) int {
+	return int(min(n, math.MaxInt))
+}
+
 // func (pl *prolog) DumpMemory(filename string) {
 // 	pages, _ := pl.memory.Grow(0)
 // 	buf, _ := pl.memory.Read(0, pages*pageSize)
@@ -443,12 +614,26 @@ func (pl *prolog) stats() Stats {
 type lockedProlog struct {
 	prolog *prolog
 	dead   bool
+	// the query that called the predicate, which outlives the RPC call (see [QueryContext])
+	query *query
 }
 
 func (pl *lockedProlog) kill() {
 	pl.dead = true
 	pl.prolog = nil
 }
+
+// QueryContext returns the context of the query that called a predicate,
+// as given to [Prolog.Query], [Prolog.QueryOnce], or [Query.Next].
+// pl must be the [Prolog] passed to the predicate, otherwise the background context is returned.
+// This is useful for canceling slow operations and passing request-scoped values to predicates.
+func QueryContext(pl Prolog) context.Context {
+	if locked, ok := pl.(*lockedProlog); ok && locked.query != nil && locked.query.ctx != nil {
+		return locked.query.ctx
+	}
+	return context.Background()
+}
+
 func (pl *lockedProlog) DumpMemory(string) {
 
 }
@@ -471,42 +656,93 @@ func (pl *lockedProlog) Query(ctx context.Context, ask string, options ...QueryO
 	if err := pl.ensure(); err != nil {
 		return &query{err: err}
 	}
-	return pl.prolog.Query(ctx, ask, append(options, withoutLock)...)
+	return pl.prolog.Query(ctx, ask, append(options, withoutLock, withParent(pl.query))...)
 }
 
 func (pl *lockedProlog) QueryOnce(ctx context.Context, query string, options ...QueryOption) (Answer, error) {
 	if err := pl.ensure(); err != nil {
 		return Answer{}, err
 	}
-	return pl.prolog.queryOnce(ctx, query, options...)
+	return pl.prolog.queryOnce(ctx, query, append(options, withParent(pl.query))...)
+}
+
+func (pl *lockedProlog) ConsultText(ctx context.Context, module, text string, options ...ConsultOption) error {
+	if err := pl.ensure(); err != nil {
+		return err
+	}
+	return pl.prolog.consultText(ctx, module, text, options...)
+}
+
+func (pl *lockedProlog) Consult(ctx context.Context, filename string, options ...ConsultOption) error {
+	if err := pl.ensure(); err != nil {
+		return err
+	}
+	return pl.prolog.consult(ctx, filename, options...)
+}
+
+func (pl *lockedProlog) ConsultFS(ctx context.Context, fsys fs.FS, name string, options ...ConsultOption) error {
+	if err := pl.ensure(); err != nil {
+		return err
+	}
+	return pl.prolog.consultFS(ctx, fsys, name, options...)
 }
 
-func (pl *lockedProlog) ConsultText(ctx context.Context, module, text string) error {
+func (pl *lockedProlog) ConsultReader(ctx context.Context, module string, r io.Reader, options ...ConsultOption) error {
 	if err := pl.ensure(); err != nil {
 		return err
 	}
-	return pl.prolog.consultText(ctx, module, text)
+	return pl.prolog.consultReader(ctx, module, r, options...)
 }
 
-func (pl *lockedProlog) Consult(_ context.Context, filename string) error {
+func (pl *lockedProlog) Register(ctx context.Context, name string, arity int, proc Predicate, opts ...RegisterOption) error {
 	if err := pl.ensure(); err != nil {
 		return err
 	}
-	return pl.prolog.consult(filename)
+	return pl.prolog.register(ctx, name, arity, proc, opts...)
 }
 
-func (pl *lockedProlog) Register(ctx context.Context, name string, arity int, proc Predicate) error {
+func (pl *lockedProlog) RegisterNondet(ctx context.Context, name string, arity int, proc NondetPredicate, opts ...RegisterOption) error {
 	if err := pl.ensure(); err != nil {
 		return err
 	}
-	return pl.prolog.register(ctx, name, arity, proc)
+	return pl.prolog.registerNondet(ctx, name, arity, proc, opts...)
 }
 
-func (pl *lockedProlog) RegisterNondet(ctx context.Context, name string, arity int, proc NondetPredicate) error {
+func (pl *lockedProlog) RegisterAsync(ctx context.Context, name string, arity int, proc AsyncPredicate, opts ...RegisterOption) error {
 	if err := pl.ensure(); err != nil {
 		return err
 	}
-	return pl.prolog.registerNondet(ctx, name, arity, proc)
+	return pl.prolog.registerAsync(ctx, name, arity, proc, opts...)
+}
+
+func (pl *lockedProlog) RegisterFunc(ctx context.Context, name string, fn any, opts ...RegisterOption) error {
+	if err := pl.ensure(); err != nil {
+		return err
+	}
+	return pl.prolog.registerFunc(ctx, name, fn, opts...)
+}
+
+func (pl *lockedProlog) Unregister(ctx context.Context, name string, arity int, opts ...RegisterOption) error {
+	if err := pl.ensure(); err != nil {
+		return err
+	}
+	return pl.prolog.unregister(ctx, name, arity, opts...)
+}
+
+func (pl *lockedProlog) Call(ctx context.Context, goal Term, options ...QueryOption) iter.Seq2[Term, error] {
+	if err := pl.ensure(); err != nil {
+		return func(yield func(Term, error) bool) {
+			yield(nil, err)
+		}
+	}
+	if q := pl.query; q != nil {
+		// output goes to the calling query, as if by call/1
+		options = append([]QueryOption{
+			WithStdout(queryWriter{query: q}),
+			WithStderr(queryWriter{query: q, stderr: true}),
+		}, options...)
+	}
+	return solve(ctx, pl.Query, goal, options)
 }
 
 func (pl *lockedProlog) Close() {
@@ -563,6 +799,42 @@ func WithLibraryPath(path string) Option {
 	}
 }
 
+// WithLibraryResolver loads libraries from Go.
+// When Prolog code loads `library(foo)` and foo isn't built into Trealla,
+// resolve is called with the name "foo" (or "foo/bar" for `library(foo/bar)`)
+// and the library's source is read from the returned reader.
+// resolve should return an error wrapping [fs.ErrNotExist] for unknown libraries.
+// Each library is resolved at most once per interpreter.
+// resolve is called while a query is running, so it must not query the interpreter.
+// This replaces WithLibraryPath.
+func WithLibraryResolver(resolve func(name string) (io.ReadCloser, error)) Option {
+	return func(pl *prolog) {
+		pl.libfs = resolve
+	}
+}
+
+// WithWASM runs the interpreter from wasm instead of the Trealla build embedded in this package,
+// for example a patched or newer version. It must export the same functions as the embedded build.
+func WithWASM(wasm []byte) Option {
+	hash := sha256.Sum256(wasm)
+	return func(pl *prolog) {
+		pl.wasm = wasm
+		pl.hash = hash
+	}
+}
+
+// WithRuntimeConfig configures the wazero runtime the interpreter runs in,
+// for example to use wazero.NewRuntimeConfigInterpreter instead of the compiler.
+// Interpreters created with the same cfg value share a runtime, but each new value creates another one,
+// which is kept until the process exits. Create cfg once and reuse it:
+// configs made by separate calls to wazero.NewRuntimeConfig are different values even if their settings match.
+// The package's compilation cache (see [SetCompilationCacheDir]) and [WithMemoryLimit] override cfg's settings.
+func WithRuntimeConfig(cfg wazero.RuntimeConfig) Option {
+	return func(pl *prolog) {
+		pl.rtcfg = cfg
+	}
+}
+
 // WithTrace enables tracing for all queries. Traces write to to the query's standard error text stream.
 // You can also use the `trace/0` predicate to enable tracing for specific queries.
 // Use together with WithStderrLog for automatic tracing.
@@ -594,6 +866,31 @@ func WithStderrLog(logger *log.Logger) Option {
 	}
 }
 
+// WithStdoutWriter streams the standard output of all queries to w as it is produced.
+// Unlike the query option [WithStdout], output is still captured in each [Answer] as well.
+func WithStdoutWriter(w io.Writer) Option {
+	return func(pl *prolog) {
+		pl.stdoutw = w
+	}
+}
+
+// WithStderrWriter streams the standard error of all queries to w as it is produced.
+// Note that traces are written to stderr.
+// Unlike the query option [WithStderr], output is still captured in each [Answer] as well.
+func WithStderrWriter(w io.Writer) Option {
+	return func(pl *prolog) {
+		pl.stderrw = w
+	}
+}
+
+// WithStdinReader sets the standard input of the interpreter, read by predicates such as read/1 using user_input.
+// It can be overridden for individual queries with [WithStdin].
+func WithStdinReader(r io.Reader) Option {
+	return func(pl *prolog) {
+		pl.stdin = r
+	}
+}
+
 // WithDebugLog writes debug messages to the given logger.
 func WithDebugLog(logger *log.Logger) Option {
 	return func(pl *prolog) {
@@ -605,7 +902,7 @@ func WithDebugLog(logger *log.Logger) Option {
 // This is useful for limiting the amount of memory an interpreter will use.
 // Set to 0 to disable concurrency limits. Default is 256.
 // Note that interpreters are single-threaded, so only one query is truly executing
-// at once, but pending queries can still consume memory (which is currently limited to 4GB).
+// at once, but pending queries can still consume memory (limited to 4GB by default, see [WithMemoryLimit]).
 // This knob will limit the number of queries that can actively consume the interpreter's memory.
 func WithMaxConcurrency(queries int) Option {
 	return func(pl *prolog) {
@@ -613,6 +910,17 @@ func WithMaxConcurrency(queries int) Option {
 	}
 }
 
+// WithMemoryLimit sets the maximum amount of memory the interpreter can use, in bytes.
+// It is rounded down to the nearest WebAssembly page (64KB), but is at least one page.
+// Queries that try to allocate past the limit will throw resource_error(memory), returned as [ErrThrow].
+// The limit must be large enough to fit the initial interpreter (around 10MB).
+// The default (and maximum) is 4GB.
+func WithMemoryLimit(bytes int) Option {
+	return func(pl *prolog) {
+		pl.memmax = bytes
+	}
+}
+
 var (
 	_ Prolog = (*prolog)(nil)
 	_ Prolog = (*lockedProlog)(nil)
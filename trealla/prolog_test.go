@@ -1,10 +1,20 @@
 package trealla
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"io"
+	"os"
+	"os/exec"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
 )
 
 func TestClose(t *testing.T) {
@@ -127,3 +137,277 @@ func TestLeakCheck(t *testing.T) {
 	t.Run("simple interop", check("interop_simple(X)", 0))
 	// t.Run("complex interop", check("interop_test(X)"))
 }
+
+func TestMemoryLimit(t *testing.T) {
+	const limit = 64 * 1024 * 1024
+	pl, err := New(WithMemoryLimit(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	if got := pl.Stats().MemoryLimit; got != limit {
+		t.Error("unexpected memory limit. want:", limit, "got:", got)
+	}
+
+	ctx := context.Background()
+	_, err = pl.QueryOnce(ctx, "findall(X, between(1, 10000000, X), Xs).")
+	var ex ErrThrow
+	if !errors.As(err, &ex) {
+		t.Fatal("unexpected error:", err, "want ErrThrow")
+	}
+	ball, ok := ex.Ball.(Compound)
+	if !ok || len(ball.Args) != 2 || !reflect.DeepEqual(ball.Args[0], Atom("resource_error").Of(Atom("memory"))) {
+		t.Error("unexpected ball. want: error(resource_error(memory), _) got:", ex.Ball)
+	}
+	if size := pl.Stats().MemorySize; size > limit {
+		t.Error("memory grew past limit:", size)
+	}
+
+	if _, err := pl.QueryOnce(ctx, "true."); err != nil {
+		t.Error("interpreter unusable after running out of memory:", err)
+	}
+
+	for _, small := range []int{1024 * 1024, 1024} {
+		if _, err := New(WithMemoryLimit(small)); err == nil {
+			t.Error("expected error for a limit too small to fit the interpreter:", small)
+		}
+	}
+}
+
+func TestCompilationCacheDir(t *testing.T) {
+	// the cache is set up once per process, so check it in a new one
+	if os.Getenv(cacheDirEnv) != "" {
+		if _, err := New(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if _, err := New(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetCompilationCacheDir(t.TempDir()); err == nil {
+		t.Error("expected error setting cache directory after first use")
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCompilationCacheDir$")
+	cmd.Env = append(os.Environ(), cacheDirEnv+"="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("compilation cache is empty")
+	}
+}
+
+func TestWASM(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("interpreter", func(t *testing.T) {
+		pl, err := New(WithRuntimeConfig(wazero.NewRuntimeConfigInterpreter()), WithWASM(tplWASM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		ans, err := pl.QueryOnce(ctx, "X is 6 * 7.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ans.Solution["X"]; got != int64(42) {
+			t.Error("bad solution:", got)
+		}
+		clone, err := pl.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := clone.QueryOnce(ctx, "true."); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("missing exports", func(t *testing.T) {
+		empty := []byte("\x00asm\x01\x00\x00\x00")
+		_, err := New(WithWASM(empty))
+		if err == nil || !strings.Contains(err.Error(), "pl_query") {
+			t.Error("unexpected error:", err)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		pl, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap, err := pl.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := append(slices.Clone(tplWASM), 0) // never compiled: the hash is checked first
+		if _, err := NewFromSnapshot(bytes.NewReader(snap), WithWASM(patched)); err == nil {
+			t.Error("expected error restoring snapshot from a different build")
+		}
+	})
+}
+
+func TestHostFunctions(t *testing.T) {
+	i32 := api.ValueTypeI32
+	var answer Term
+	add := HostFunction{
+		Module:  "custom",
+		Name:    "add",
+		Params:  []api.ValueType{i32, i32},
+		Results: []api.ValueType{i32},
+		Func: func(ctx context.Context, pl Prolog, subquery Subquery, mod api.Module, stack []uint64) {
+			ans, err := pl.QueryOnce(ctx, "X = ok.")
+			if err != nil {
+				t.Error(err)
+			}
+			answer = ans.Solution["X"]
+			stack[0] = api.EncodeI32(api.DecodeI32(stack[0]) + api.DecodeI32(stack[1]))
+		},
+	}
+	opt := WithHostFunctions(add)
+	pl, err := New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	clone, err := pl.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.(*prolog).host != pl.(*prolog).host {
+		t.Error("clone has different host functions")
+	}
+
+	// the embedded interpreter doesn't import it, so call it from a module that does
+	runtimes.mu.Lock()
+	engine := runtimes.engines[runtimeKey{hash: wasmHash(), host: pl.(*prolog).host}]
+	runtimes.mu.Unlock()
+	if engine == nil {
+		t.Fatal("runtime not found")
+	}
+	caller, err := engine.Instantiate(pl.(*prolog).ctx, []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		// type 0: (i32, i32) -> i32
+		0x01, 0x07, 0x01, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f,
+		// import custom.add
+		0x02, 0x0e, 0x01, 0x06, 'c', 'u', 's', 't', 'o', 'm', 0x03, 'a', 'd', 'd', 0x00, 0x00,
+		0x03, 0x02, 0x01, 0x00,
+		// export call
+		0x07, 0x08, 0x01, 0x04, 'c', 'a', 'l', 'l', 0x00, 0x01,
+		// call: local.get 0, local.get 1, call add
+		0x0a, 0x0a, 0x01, 0x08, 0x00, 0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x0b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close(pl.(*prolog).ctx)
+	results, err := caller.ExportedFunction("call").Call(pl.(*prolog).ctx, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0] != 5 {
+		t.Error("bad result:", results)
+	}
+	if answer != Atom("ok") {
+		t.Error("bad answer from callback:", answer)
+	}
+
+	dupe := HostFunction{Name: "host-call", Func: add.Func}
+	if _, err := New(WithHostFunctions(dupe)); err == nil {
+		t.Error("expected error for duplicate host function")
+	}
+}
+
+func TestClauseScanner(t *testing.T) {
+	text := "a(1).\n" +
+		"b('it''s. ok', \"x. y\", `z. `).\n" +
+		"% comment. here\n" +
+		"c :- X = 0'., Y = 0''', Z =.. [f], W = \"\\\". \".\n" +
+		"/* block. */ d(1.5).\n" +
+		"e"
+	want := []string{
+		"a(1).",
+		"\nb('it''s. ok', \"x. y\", `z. `).",
+		"\n% comment. here\nc :- X = 0'., Y = 0''', Z =.. [f], W = \"\\\". \".",
+		"\n/* block. */ d(1.5).",
+		"\ne",
+	}
+	sc := clauseScanner{r: bufio.NewReader(strings.NewReader(text))}
+	var got []string
+	for {
+		chunk, err := sc.next(1)
+		got = append(got, chunk)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad chunks.\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestContextModule(t *testing.T) {
+	tests := map[string]Atom{
+		"go.":            "user",
+		"foo:go.":        "foo",
+		" foo : (a, b).": "foo",
+		"'my mod':go.":   "my mod",
+		"'it''s':go.":    "it's",
+		"X = 1, foo:go.": "user",
+		"Foo:go.":        "user",
+		"foo:-go.":       "user",
+		"foo::go.":       "user",
+		"write('a:b').":  "user",
+		"call(foo:go).":  "user",
+	}
+	for goal, want := range tests {
+		if got := contextModule(goal); got != want {
+			t.Errorf("contextModule(%q) = %q, want %q", goal, got, want)
+		}
+	}
+}
+
+func TestParseDiagnostic(t *testing.T) {
+	tests := map[string]Diagnostic{
+		"Error: syntax error, near '2', operator expected, /foo.pl:6": {
+			Severity: SeverityError, File: "/foo.pl", Line: 6, Token: "2", Message: "operator expected", Syntax: true,
+		},
+		"Error: syntax error, near 'a, b', operator expected, wasm:1": {
+			Severity: SeverityError, File: "wasm", Line: 1, Token: "a, b", Message: "operator expected", Syntax: true,
+		},
+		"Error: syntax error, near 'it's', operator expected, wasm:1": {
+			Severity: SeverityError, File: "wasm", Line: 1, Token: "it's", Message: "operator expected", Syntax: true,
+		},
+		"Error: syntax error, near ',', operator expected, wasm:1": {
+			Severity: SeverityError, File: "wasm", Line: 1, Token: ",", Message: "operator expected", Syntax: true,
+		},
+		`Error: syntax error, near "a, b", operator expected, wasm:2`: {
+			Severity: SeverityError, File: "wasm", Line: 2, Token: "a, b", Message: "operator expected", Syntax: true,
+		},
+		`Error: syntax error, near "x'y", operator expected, wasm:2`: {
+			Severity: SeverityError, File: "wasm", Line: 2, Token: "x'y", Message: "operator expected", Syntax: true,
+		},
+		"Error: syntax error, near 3, operator expected, wasm:2": {
+			Severity: SeverityError, File: "wasm", Line: 2, Token: "3", Message: "operator expected", Syntax: true,
+		},
+		"Warning: singleton: X, near /foo.pl:1": {
+			Severity: SeverityWarning, File: "/foo.pl", Line: 1, Message: "singleton: X",
+		},
+	}
+	for line, want := range tests {
+		got, ok := parseDiagnostic(line)
+		if !ok || got != want {
+			t.Errorf("parseDiagnostic(%q) = %#v, %v, want %#v", line, got, ok, want)
+		}
+	}
+}
@@ -6,19 +6,26 @@ import (
 	"fmt"
 	"io"
 	"iter"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const stx = '\x02' // START OF TEXT
 const etx = '\x03' // END OF TEXT
 
+// yieldTime is how long a cancelable, streaming, or output-limited query runs before checking in with us.
+const yieldTime = 10 * time.Millisecond
+
 type queryContext struct{}
 
 // Query is a Prolog query iterator.
 type Query interface {
 	// Next computes the next solution. Returns true if it found one and false if there are no more results.
+	// If ctx is canceled while computing, the query is aborted and Err will return [ErrCanceled].
 	// Be sure to check for errors by calling Err afterwards.
 	Next(context.Context) bool
 	// All returns an iterator over query results.
@@ -31,17 +38,25 @@ type Query interface {
 	Close() error
 	// Err returns this query's error. Always check this after iterating.
 	// Query failures are represented as [ErrFailure] and queries that throw an exception as [ErrThrow].
+	// Queries interrupted by their context being canceled return [ErrCanceled].
 	Err() error
 }
 
 type query struct {
 	pl       *prolog
+	ctx      context.Context // context of the latest start or redo, for predicates
 	goal     string
 	bind     bindings
 	subquery uint32 // pl_sub_query*
 
 	// in-flight coroutines
 	coros map[int64]struct{}
+	// handles to Go values created by this query's predicates
+	handles map[int64]struct{}
+	// the query whose predicate started this one, if any, whose handles this query can use
+	parent *query
+	// in-flight async predicate
+	async *asyncCall
 
 	cur     Answer
 	answers []Answer
@@ -58,6 +73,18 @@ type query struct {
 
 	stdout *bytes.Buffer
 	stderr *bytes.Buffer
+	// streaming output, replaces stdout and stderr buffers if set
+	stdoutw io.Writer
+	stderrw io.Writer
+
+	stdin io.Reader
+
+	// module is the goal's context module, see contextModule
+	module Atom
+
+	maxout    int  // output limit in bytes
+	outlen    int  // total output so far
+	truncated bool // output was discarded since the last answer
 
 	lock bool
 	mu   *sync.Mutex
@@ -71,14 +98,16 @@ func (pl *prolog) Query(ctx context.Context, goal string, options ...QueryOption
 }
 
 func (pl *prolog) QueryOnce(ctx context.Context, goal string, options ...QueryOption) (Answer, error) {
-	pl.mu.Lock()
-	defer pl.mu.Unlock()
-	return pl.queryOnce(ctx, goal, options...)
+	return once(ctx, pl.start(ctx, goal, options...))
 }
 
 func (pl *prolog) queryOnce(ctx context.Context, goal string, options ...QueryOption) (Answer, error) {
 	options = append(options, withoutLock)
-	q := pl.start(ctx, goal, options...)
+	return once(ctx, pl.start(ctx, goal, options...))
+}
+
+// once returns the first answer of q and closes it.
+func once(ctx context.Context, q *query) (Answer, error) {
 	var ans Answer
 	if q.Next(ctx) {
 		ans = q.Current()
@@ -118,18 +147,27 @@ func (q *query) allocCapture() error {
 }
 
 func (q *query) readOutput() error {
-	pl := q.pl
-	var err error
+	stdout, stderr, err := q.readCapture()
+	if err != nil {
+		return err
+	}
+	q.output(stdout, q.stdout, q.stdoutw, q.pl.stdoutw)
+	q.output(stderr, q.stderr, q.stderrw, q.pl.stderrw)
+	return nil
+}
 
+// readCapture returns the output the interpreter captured since it was last read, and clears it.
+func (q *query) readCapture() (stdout, stderr string, err error) {
+	pl := q.pl
 	if err := q.allocCapture(); err != nil {
-		return err
+		return "", "", err
 	}
 
 	_, err = pl.pl_capture_read.Call(pl.ctx, uint64(pl.ptr),
 		uint64(q.stdoutptr), uint64(q.stdoutlen),
 		uint64(q.stderrptr), uint64(q.stderrlen))
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	defer pl.pl_capture_reset.Call(pl.ctx, uint64(pl.ptr))
 
@@ -138,24 +176,71 @@ func (q *query) readOutput() error {
 	stderrlen := pl.indirect(q.stderrlen)
 	stderrptr := pl.indirect(q.stderrptr)
 
-	stdout, err := pl.gets(stdoutptr, stdoutlen)
+	stdout, err = pl.gets(stdoutptr, stdoutlen)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	q.stdout.WriteString(stdout)
-
-	stderr, err := pl.gets(stderrptr, stderrlen)
+	stderr, err = pl.gets(stderrptr, stderrlen)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	q.stderr.WriteString(stderr)
+	return stdout, stderr, nil
+}
 
-	return nil
+// output sends text to the query's writer if it has one, otherwise to its buffer.
+// The interpreter's writer (if any) gets a copy too.
+// Text past the query's output limit goes nowhere.
+func (q *query) output(text string, buf *bytes.Buffer, w, plw io.Writer) {
+	if text == "" {
+		return
+	}
+	if q.maxout > 0 {
+		if room := q.maxout - q.outlen; len(text) > room {
+			// don't split UTF-8 sequences
+			for room > 0 && !utf8.RuneStart(text[room]) {
+				room--
+			}
+			text = text[:max(room, 0)]
+			q.truncated = true
+		}
+		q.outlen += len(text)
+		if text == "" {
+			return
+		}
+	}
+	if plw != nil {
+		io.WriteString(plw, text)
+	}
+	if w == nil {
+		buf.WriteString(text)
+		return
+	}
+	if _, err := io.WriteString(w, text); err != nil {
+		q.setError(fmt.Errorf("trealla: failed to write query output: %w", err))
+	}
+}
+
+// queryWriter writes to the output of query, used for nested queries.
+type queryWriter struct {
+	query  *query
+	stderr bool
+}
+
+func (w queryWriter) Write(p []byte) (int, error) {
+	q := w.query
+	// the interpreter's writer already got a copy from the nested query
+	if w.stderr {
+		q.output(string(p), q.stderr, q.stderrw, nil)
+	} else {
+		q.output(string(p), q.stdout, q.stdoutw, nil)
+	}
+	return len(p), nil
 }
 
 func (q *query) resetOutput() {
 	q.stdout.Reset()
 	q.stderr.Reset()
+	q.truncated = false
 }
 
 func (pl *prolog) start(ctx context.Context, goal string, options ...QueryOption) *query {
@@ -184,8 +269,21 @@ func (pl *prolog) start(ctx context.Context, goal string, options ...QueryOption
 		return q
 	}
 
+	if err := ctx.Err(); err != nil {
+		q.setError(ErrCanceled{Query: q.goal, Cause: err})
+		return q
+	}
+
+	if err := pl.resetInput(q.stdin); err != nil {
+		q.setError(err)
+		return q
+	}
+	defer pl.input.use(q.stdin)()
+
+	q.ctx = ctx
 	ctx = context.WithValue(ctx, queryContext{}, q)
 
+	q.module = contextModule(q.goal)
 	if err := q.reify(); err != nil {
 		q.setError(err)
 		return q
@@ -216,34 +314,12 @@ func (pl *prolog) start(ctx context.Context, goal string, options ...QueryOption
 		return q
 	}
 
-	// ch := make(chan error, 2)
 	var ret uint32
-	v, err := pl.pl_query.Call(ctx, uint64(pl.ptr), uint64(goalstr.ptr), uint64(subqptr), 0)
+	v, err := pl.pl_query.Call(ctx, uint64(pl.ptr), uint64(goalstr.ptr), uint64(subqptr), uint64(q.yieldInterval(ctx)))
 	if err == nil {
 		ret = uint32(v[0])
 	}
 	goalstr.free(pl)
-	// go func() {
-	// 	defer func() {
-	// 		if ex := recover(); ex != nil {
-	// 			ch <- fmt.Errorf("trealla: panic: %v", ex)
-	// 		}
-	// 	}()
-
-	// 	v, err := pl.pl_query.Call(pl.ctx, uint64(pl.ptr), uint64(goalstr.ptr), uint64(subqptr), 0)
-	// 	if err == nil {
-	// 		ret = uint32(v[0])
-	// 	}
-	// 	goalstr.free(pl)
-	// 	ch <- err
-	// }()
-
-	// select {
-	// case <-ctx.Done():
-	// 	q.setError(fmt.Errorf("trealla: canceled: %w", ctx.Err()))
-	// 	return q
-
-	// case err := <-ch:
 	q.done = ret == 0
 
 	if err != nil {
@@ -262,12 +338,18 @@ func (pl *prolog) start(ctx context.Context, goal string, options ...QueryOption
 		q.pl.running[q.subquery] = q
 	}
 
+	if !q.done {
+		if !q.resume(ctx) {
+			q.close()
+			return q
+		}
+	}
+
 	if pl.closing {
 		pl.Close()
 	}
 
 	return q
-	// }
 }
 
 func (q *query) redo(ctx context.Context) bool {
@@ -285,37 +367,24 @@ func (q *query) redo(ctx context.Context) bool {
 	}
 
 	pl := q.pl
+	q.ctx = ctx
 	ctx = context.WithValue(ctx, queryContext{}, q)
+	defer pl.input.use(q.stdin)()
 
-	// ch := make(chan error, 2)
-	var ret uint32
-	// go func() {
-	// 	defer func() {
-	// 		if ex := recover(); ex != nil {
-	// 			ch <- fmt.Errorf("trealla: panic: %v", ex)
-	// 		}
-	// 	}()
-
-	// 	v, err := pl.pl_redo.Call(pl.ctx, uint64(q.subquery))
-	// 	if err == nil {
-	// 		ret = uint32(v[0])
-	// 	}
-	// 	ch <- err
-	// }()
+	if ms := q.yieldInterval(ctx); ms > 0 {
+		if _, err := pl.pl_yield_at.Call(pl.ctx, uint64(q.subquery), uint64(ms)); err != nil {
+			q.setError(fmt.Errorf("trealla: query error: %w", err))
+			q.close()
+			return false
+		}
+	}
 
+	var ret uint32
 	v, err := pl.pl_redo.Call(ctx, uint64(q.subquery))
 	q.iter++
 	if err == nil {
 		ret = uint32(v[0])
 	}
-
-	// select {
-	// case <-ctx.Done():
-	// 	q.setError(fmt.Errorf("trealla: canceled: %w", ctx.Err()))
-	// 	q.Close()
-	// 	return false
-
-	// case err := <-ch:
 	q.done = ret == 0
 	if err != nil {
 		q.setError(fmt.Errorf("trealla: query error: %w", err))
@@ -323,17 +392,10 @@ func (q *query) redo(ctx context.Context) bool {
 		return false
 	}
 
-	// var erroring bool
-	// var errcode uint64
-	// {
-	// 	retv, err2 := pl.get_error.Call(ctx, uint64(pl.ptr))
-	// 	if err2 != nil {
-	// 		q.setError(fmt.Errorf("trealla: get_error internal error: %w", err))
-	// 		return false
-	// 	}
-	// 	errcode = retv[0]
-	// 	erroring = errcode != 0
-	// }
+	if !q.done && !q.resume(ctx) {
+		q.close()
+		return false
+	}
 
 	if q.done {
 		delete(pl.running, q.subquery)
@@ -350,6 +412,124 @@ func (q *query) redo(ctx context.Context) bool {
 	return true
 }
 
+// resume continues a query for as long as it keeps yielding back to us,
+// which it does every yieldTime when the context can be canceled or output is streamed or limited,
+// and while waiting for async predicates.
+// Returns false if the query was canceled or failed while resuming.
+func (q *query) resume(ctx context.Context) bool {
+	pl := q.pl
+	for {
+		v, err := pl.query_did_yield.Call(pl.ctx, uint64(q.subquery))
+		if err != nil {
+			q.setError(fmt.Errorf("trealla: query error: %w", err))
+			return false
+		}
+		if uint32(v[0]) == 0 {
+			return true
+		}
+
+		// flush output so writers can see progress
+		if err := q.readOutput(); err != nil {
+			q.setError(err)
+			return false
+		}
+
+		if err := ctx.Err(); err != nil {
+			if pl.debug != nil {
+				pl.debug.Println("canceled:", q.subquery, q.goal)
+			}
+			q.setError(ErrCanceled{Query: q.goal, Cause: err})
+			return false
+		}
+
+		if q.async != nil && !q.await(ctx) {
+			return false
+		}
+
+		if ms := q.yieldInterval(ctx); ms > 0 {
+			if _, err := pl.pl_yield_at.Call(pl.ctx, uint64(q.subquery), uint64(ms)); err != nil {
+				q.setError(fmt.Errorf("trealla: query error: %w", err))
+				return false
+			}
+		}
+		v, err = pl.pl_redo.Call(ctx, uint64(q.subquery))
+		if err != nil {
+			q.setError(fmt.Errorf("trealla: query error: %w", err))
+			return false
+		}
+		if uint32(v[0]) == 0 {
+			q.done = true
+			return true
+		}
+	}
+}
+
+// callAsync runs proc in the background.
+// The query yields until it's done, see await.
+func (q *query) callAsync(ctx context.Context, proc AsyncPredicate, subq Subquery, goal Term, module Atom) {
+	ctx, cancel := context.WithCancel(ctx)
+	call := &asyncCall{
+		module: module,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	q.async = call
+	go func() {
+		defer close(call.done)
+		call.result = catch(func(Prolog, Subquery, Term) Term {
+			return proc(ctx, subq, goal)
+		}, nil, subq, goal)
+	}()
+}
+
+// await waits for the query's async predicate to finish.
+// The interpreter is unlocked in the meantime so other queries can run,
+// unless this query was started by a predicate (in which case the lock isn't ours to give up).
+// Returns false if the query was canceled or the interpreter closed while waiting.
+func (q *query) await(ctx context.Context) bool {
+	pl := q.pl
+	call := q.async
+	if q.lock {
+		pl.mu.Unlock()
+	}
+	var err error
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if q.lock {
+		pl.mu.Lock()
+	}
+	if err != nil {
+		if pl.debug != nil {
+			pl.debug.Println("canceled:", q.subquery, q.goal)
+		}
+		q.setError(ErrCanceled{Query: q.goal, Cause: err})
+		return false
+	}
+	if pl.instance == nil {
+		q.setError(io.EOF)
+		return false
+	}
+	return true
+}
+
+// yieldInterval returns how often (in milliseconds) a query running under ctx
+// should pause to check for cancellation and flush its output,
+// or 0 if it doesn't need to.
+func (q *query) yieldInterval(ctx context.Context) uint32 {
+	if ctx.Done() == nil && q.maxout == 0 && !q.streaming() {
+		return 0
+	}
+	return uint32(yieldTime.Milliseconds())
+}
+
+// streaming reports whether the query's output goes to a writer as it's produced.
+func (q *query) streaming() bool {
+	return q.stdoutw != nil || q.stderrw != nil || q.pl.stdoutw != nil || q.pl.stderrw != nil
+}
+
 func (q *query) Next(ctx context.Context) bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -425,6 +605,10 @@ func (q *query) Close() error {
 func (q *query) close() error {
 	if !q.dead {
 		q.dead = true
+		if q.async != nil {
+			q.async.cancel()
+			q.async = nil
+		}
 		if q.pl.limiter != nil {
 			defer func() {
 				<-q.pl.limiter
@@ -436,6 +620,10 @@ func (q *query) close() error {
 			}
 			q.pl.CoroStop(Subquery(q.subquery), coro)
 		}
+		for id := range q.handles {
+			delete(q.pl.handles, id)
+		}
+		q.handles = nil
 	}
 
 	if q.subquery != 0 {
@@ -449,6 +637,29 @@ func (q *query) close() error {
 		q.pl.pl_capture_free.Call(q.pl.ctx, uint64(q.pl.ptr))
 	}
 
+	q.freeCapture()
+
+	// q.pl = nil
+
+	return nil
+}
+
+// forget detaches q from the interpreter's memory, which is about to be rolled back.
+// Nothing is freed, so closing q later only releases what lives outside of that memory.
+func (q *query) forget() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.setError(fmt.Errorf("trealla: query was rolled back"))
+	q.answers = nil
+	q.done = true
+	q.subquery = 0
+	q.coros = nil
+	q.handles = nil
+	q.stdoutptr, q.stdoutlen, q.stderrptr, q.stderrlen = 0, 0, 0, 0
+}
+
+// freeCapture frees the pointers allocated by allocCapture.
+func (q *query) freeCapture() {
 	if q.stdoutptr != 0 {
 		q.pl.free.Call(q.pl.ctx, uint64(q.stdoutptr), ptrSize, align)
 		q.stdoutptr = 0
@@ -465,10 +676,6 @@ func (q *query) close() error {
 		q.pl.free.Call(q.pl.ctx, uint64(q.stderrlen), ptrSize, align)
 		q.stderrlen = 0
 	}
-
-	// q.pl = nil
-
-	return nil
 }
 
 func (q *query) bindVar(name string, value Term) {
@@ -510,6 +717,19 @@ func (q *query) Err() error {
 	return q.err
 }
 
+// contextModuleRE matches a goal of the form Module:Goal.
+var contextModuleRE = regexp.MustCompile(`^\s*([a-z][a-zA-Z0-9_]*|'(?:[^']|'')*')\s*:[^-:]`)
+
+// contextModule returns the module a query's goal runs in:
+// Module for goals of the form Module:Goal, otherwise user.
+func contextModule(goal string) Atom {
+	m := contextModuleRE.FindStringSubmatch(goal)
+	if m == nil {
+		return "user"
+	}
+	return Atom(unquoteAtom(m[1]))
+}
+
 func escapeQuery(query string) string {
 	query = queryEscaper.Replace(query)
 	return fmt.Sprintf(`wasm:js_ask(%s).`, escapeString(query))
@@ -537,10 +757,57 @@ func WithBinding(subs Substitution) QueryOption {
 	}
 }
 
+// WithStdout streams the query's standard output to w as it is produced,
+// instead of capturing it in [Answer] and errors.
+// Output is written whenever the query calls into Go, finds an answer, or
+// periodically while it runs.
+func WithStdout(w io.Writer) QueryOption {
+	return func(q *query) {
+		q.stdoutw = w
+	}
+}
+
+// WithStderr streams the query's standard error to w as it is produced,
+// instead of capturing it in [Answer] and errors.
+// See [WithStdout] for details.
+func WithStderr(w io.Writer) QueryOption {
+	return func(q *query) {
+		q.stderrw = w
+	}
+}
+
+// WithStdin sets the standard input of the query, read by predicates such as read/1 using user_input.
+// This overrides the interpreter's standard input set by [WithStdinReader].
+// Text read from r but not consumed by this query is discarded before the next query starts.
+func WithStdin(r io.Reader) QueryOption {
+	return func(q *query) {
+		q.stdin = r
+	}
+}
+
+// WithMaxOutput limits the amount of standard output and standard error text
+// (combined, in bytes) that a query will capture or stream over its lifetime.
+// Output past the limit is discarded, including the copy sent to the interpreter's writers,
+// and the affected answers and errors are marked as Truncated (see [Answer], [ErrFailure], and [ErrThrow]).
+// This protects against runaway output, but does not stop the query itself;
+// use a context with a deadline for that.
+func WithMaxOutput(bytes int) QueryOption {
+	return func(q *query) {
+		q.maxout = bytes
+	}
+}
+
 func withoutLock(q *query) {
 	q.lock = false
 }
 
+// withParent sets the query whose predicate is starting this one.
+func withParent(parent *query) QueryOption {
+	return func(q *query) {
+		q.parent = parent
+	}
+}
+
 var queryEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", "")
 
 var _ Query = (*query)(nil)
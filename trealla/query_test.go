@@ -1,18 +1,26 @@
 package trealla_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"math/big"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/trealla-prolog/go/trealla"
 )
@@ -311,6 +319,92 @@ func TestThrow(t *testing.T) {
 	}
 }
 
+func TestISOErrors(t *testing.T) {
+	pl, err := trealla.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	pi := func(name trealla.Atom, arity int) trealla.Term {
+		return trealla.Atom("/").Of(name, int64(arity))
+	}
+
+	// as runs errors.As with a pointer to a fresh value of want's type
+	as := func(err error, want error) (any, bool) {
+		target := reflect.New(reflect.TypeOf(want))
+		ok := errors.As(err, target.Interface())
+		return target.Elem().Interface(), ok
+	}
+
+	table := []struct {
+		query string
+		want  error
+	}{
+		{
+			query: "X is foo + 1.",
+			want:  trealla.TypeError{Type: "evaluable", Culprit: pi("foo", 0), Context: pi("+", 2)},
+		},
+		{
+			query: "atom_length(abc, -1).",
+			want:  trealla.DomainError{Domain: "not_less_than_zero", Culprit: int64(-1), Context: pi("atom_length", 2)},
+		},
+		{
+			query: "nope.",
+			want:  trealla.ExistenceError{Type: "procedure", Culprit: pi("nope", 0), Context: pi("nope", 0)},
+		},
+		{
+			query: "asserta(atom_length(_, _)).",
+			want:  trealla.PermissionError{Action: "modify", Type: "static_procedure", Culprit: pi("atom_length", 2), Context: pi("asserta", 1)},
+		},
+		{
+			query: "throw(error(resource_error(memory), foo/0)).",
+			want:  trealla.ResourceError{Resource: trealla.Atom("memory"), Context: pi("foo", 0)},
+		},
+		{
+			query: "throw(error(syntax_error(operator_expected), foo/0)).",
+			want:  trealla.SyntaxError{Description: trealla.Atom("operator_expected"), Context: pi("foo", 0), Message: "operator expected"},
+		},
+		{
+			query: "X is 1/0.",
+			want:  trealla.EvaluationError{Kind: "zero_divisor", Context: pi("/", 2)},
+		},
+		{
+			query: "X is Y + 1.",
+			want:  trealla.InstantiationError{Context: trealla.Atom("number")},
+		},
+	}
+	for _, tc := range table {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := pl.QueryOnce(ctx, tc.query)
+			var ex trealla.ErrThrow
+			if !errors.As(err, &ex) {
+				t.Fatal("unexpected error:", err, "want ErrThrow")
+			}
+			got, ok := as(err, tc.want)
+			if !ok {
+				t.Fatalf("errors.As failed for %T: %v", tc.want, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("bad error.\nwant: %#v\ngot:  %#v", tc.want, got)
+			}
+			if term := got.(interface{ Term() trealla.Compound }).Term(); !reflect.DeepEqual(term, ex.Ball) {
+				t.Errorf("bad term.\nwant: %v\ngot:  %v", ex.Ball, term)
+			}
+		})
+	}
+
+	t.Run("other balls", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, "throw(error(my_error, foo)).")
+		var te trealla.TypeError
+		if errors.As(err, &te) {
+			t.Error("unexpected type error:", te)
+		}
+		if !errors.As(err, &trealla.ErrThrow{}) {
+			t.Error("expected ErrThrow, got:", err)
+		}
+	})
+}
+
 // func TestInterpError(t *testing.T) {
 // 	pl, err := trealla.New()
 // 	if err != nil {
@@ -404,6 +498,489 @@ func TestSyntaxError(t *testing.T) {
 	if !reflect.DeepEqual(ex.Ball, want) {
 		t.Error(`unexpected error value. want:`, want, `got:`, ex.Ball)
 	}
+
+	var se trealla.SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatal("unexpected error:", err, "want SyntaxError")
+	}
+	if se.Message != "mismatched parens or brackets or braces" {
+		t.Error("unexpected message:", se.Message)
+	}
+}
+
+func TestConsultDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	pl, err := trealla.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("text", func(t *testing.T) {
+		var diags []trealla.Diagnostic
+		text := "foo(X) :- true.\nbar(1).\nbaz :- qux(1 2).\n"
+		err := pl.ConsultText(ctx, "diag", text, trealla.WithDiagnostics(func(d trealla.Diagnostic) {
+			diags = append(diags, d)
+		}))
+		var ce trealla.ConsultError
+		if !errors.As(err, &ce) {
+			t.Fatal("unexpected error:", err, "want ConsultError")
+		}
+		want := []trealla.Diagnostic{
+			{Severity: trealla.SeverityWarning, Line: 1, Message: "singleton: X"},
+			{Severity: trealla.SeverityError, Line: 3, Token: "2", Message: "operator expected", Syntax: true},
+		}
+		if !reflect.DeepEqual(ce.Diagnostics, want) {
+			t.Errorf("bad diagnostics.\nwant: %#v\ngot:  %#v", want, ce.Diagnostics)
+		}
+		if !reflect.DeepEqual(diags, want) {
+			t.Errorf("bad callback diagnostics.\nwant: %#v\ngot:  %#v", want, diags)
+		}
+
+		var se trealla.SyntaxError
+		if !errors.As(err, &se) {
+			t.Fatal("unexpected error:", err, "want SyntaxError")
+		}
+		if se.Line != 3 || se.Column != 0 || se.Token != "2" || se.Message != "operator expected" {
+			t.Errorf("bad syntax error: %#v", se)
+		}
+		if want := `trealla: syntax error: 3: operator expected (near "2")`; se.Error() != want {
+			t.Errorf("bad message. want: %s got: %s", want, se.Error())
+		}
+	})
+
+	t.Run("directive output", func(t *testing.T) {
+		var diags []trealla.Diagnostic
+		text := ":- initialization((write('Error: something, x:3'), nl)).\n" +
+			":- initialization((write(user_error, 'Warning: something else'), nl(user_error))).\n"
+		err := pl.ConsultText(ctx, "diag3", text, trealla.WithDiagnostics(func(d trealla.Diagnostic) {
+			diags = append(diags, d)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diags) > 0 {
+			t.Error("unexpected diagnostics:", diags)
+		}
+	})
+
+	t.Run("warnings only", func(t *testing.T) {
+		var diags []trealla.Diagnostic
+		err := pl.ConsultText(ctx, "diag2", "foo(X) :- true.", trealla.WithDiagnostics(func(d trealla.Diagnostic) {
+			diags = append(diags, d)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diags) != 1 || diags[0].Severity != trealla.SeverityWarning {
+			t.Error("unexpected diagnostics:", diags)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		pl, err := trealla.New(trealla.WithMapFS("/lint", fstest.MapFS{
+			"syntax_error.pl": &fstest.MapFile{Data: []byte("ok(1).\nbroken(.\nok(2).\n")},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pl.Consult(ctx, "/lint/syntax_error.pl")
+		var ce trealla.ConsultError
+		if !errors.As(err, &ce) {
+			t.Fatal("unexpected error:", err, "want ConsultError")
+		}
+		want := []trealla.Diagnostic{
+			{Severity: trealla.SeverityError, File: "/lint/syntax_error.pl", Line: 2, Message: "mismatched parens/brackets/braces", Syntax: true},
+		}
+		if !reflect.DeepEqual(ce.Diagnostics, want) {
+			t.Errorf("bad diagnostics.\nwant: %#v\ngot:  %#v", want, ce.Diagnostics)
+		}
+	})
+}
+
+func TestConsultFS(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"main.pl":       &fstest.MapFile{Data: []byte(":- ensure_loaded('lib/helper.pl').\n:- include('inc.pl').\n:- use_module('lib/mod').\nmain(X, Y, Z) :- helper(X), included(Y), m(Z).\n")},
+		"inc.pl":        &fstest.MapFile{Data: []byte("included(2).\n")},
+		"lib/helper.pl": &fstest.MapFile{Data: []byte("helper(1).\n")},
+		"lib/mod.pl":    &fstest.MapFile{Data: []byte(":- module(mod, [m/1]).\nm(3).\n")},
+		"lib/bad.pl":    &fstest.MapFile{Data: []byte("ok.\nbad(.\n")},
+	}
+	ctx := context.Background()
+
+	for _, opts := range [][]trealla.Option{nil, {trealla.WithPreopenDir("testdata")}} {
+		pl, err := trealla.New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pl.ConsultFS(ctx, fsys, "main.pl"); err != nil {
+			t.Fatal(err)
+		}
+		ans, err := pl.QueryOnce(ctx, "main(X, Y, Z).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := trealla.Substitution{"X": int64(1), "Y": int64(2), "Z": int64(3)}
+		if !reflect.DeepEqual(ans.Solution, want) {
+			t.Error("bad solution. want:", want, "got:", ans.Solution)
+		}
+
+		err = pl.ConsultFS(ctx, fsys, "lib/bad.pl")
+		var se trealla.SyntaxError
+		if !errors.As(err, &se) {
+			t.Fatal("unexpected error:", err, "want SyntaxError")
+		}
+		if se.File != "lib/bad.pl" || se.Line != 2 {
+			t.Error("bad position:", se.File, se.Line)
+		}
+	}
+}
+
+func TestConsultReader(t *testing.T) {
+	t.Parallel()
+
+	pl, err := trealla.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// big enough to be loaded in a few chunks
+	const n = 10000
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(w, "fact(%d, 'it''s a fact. really').\n", i)
+		}
+		fmt.Fprintln(w, "bad(.")
+		w.Close()
+	}()
+	err = pl.ConsultReader(ctx, "gen", r)
+	var se trealla.SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatal("unexpected error:", err, "want SyntaxError")
+	}
+	if se.Line != n+1 {
+		t.Error("bad line. want:", n+1, "got:", se.Line)
+	}
+
+	ans, err := pl.QueryOnce(ctx, "findall(X, gen:fact(X, _), Xs), length(Xs, N).")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ans.Solution["N"]; got != int64(n) {
+		t.Error("wrong number of facts. want:", n, "got:", got)
+	}
+}
+
+func TestLibraryResolver(t *testing.T) {
+	t.Parallel()
+
+	libs := map[string]string{
+		"greet":     ":- module(greet, [greet/1]).\n:- use_module(library(util/name)).\ngreet(X) :- name(N), atom_concat(hello_, N, X).\n",
+		"util/name": ":- module(name, [name/1]).\nname(world).\n",
+		"lists":     ":- module(lists, []).\n",
+	}
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	resolve := func(name string) (io.ReadCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[name]++
+		text, ok := libs[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		return io.NopCloser(strings.NewReader(text)), nil
+	}
+	ctx := context.Background()
+
+	pl, err := trealla.New(trealla.WithLibraryResolver(resolve))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := pl.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pl := range []trealla.Prolog{pl, clone} {
+		ans, err := pl.QueryOnce(ctx, "use_module(library(greet)), greet(X), use_module(library(lists)), last([a,b], Y).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := trealla.Substitution{"X": trealla.Atom("hello_world"), "Y": trealla.Atom("b")}
+		if !reflect.DeepEqual(ans.Solution, want) {
+			t.Error("bad solution. want:", want, "got:", ans.Solution)
+		}
+
+		if _, err := pl.QueryOnce(ctx, "use_module(library(nope))."); err == nil {
+			t.Error("expected error loading unknown library")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["lists"] != 0 {
+		t.Error("resolver called for built-in library")
+	}
+	// once per interpreter
+	if calls["greet"] != 2 || calls["util/name"] != 2 {
+		t.Error("wrong number of resolver calls:", calls)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	stamp := time.Now()
+	write := func(name, text string) {
+		t.Helper()
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// make sure the change is visible even if the file system's clock is coarse
+		stamp = stamp.Add(time.Second)
+		if err := os.Chtimes(file, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	pl, err := trealla.New(trealla.WithMapDir("/rules", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := func() any {
+		t.Helper()
+		ans, err := pl.QueryOnce(ctx, "rule(X).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ans.Solution["X"]
+	}
+
+	write("rules.pl", "rule(1).\n")
+	if err := pl.Consult(ctx, "/rules/rules.pl"); err != nil {
+		t.Fatal(err)
+	}
+	write("mod.pl", ":- module(mod, [value/1]).\nvalue(1).\n")
+	if err := pl.Consult(ctx, "/rules/mod.pl"); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	w := trealla.Watch(ctx, pl, trealla.WithWatchInterval(10*time.Millisecond), trealla.WithWatchError(func(err error) {
+		errs <- err
+	}))
+	defer w.Close()
+
+	t.Run("reload", func(t *testing.T) {
+		write("rules.pl", "rule(2).\n")
+		deadline := time.Now().Add(5 * time.Second)
+		for rule() != int64(2) {
+			if time.Now().After(deadline) {
+				t.Fatal("file not reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		write("rules.pl", "rule(3).\nrule(4) :- .\n")
+		var ce trealla.ConsultError
+		select {
+		case err := <-errs:
+			if !errors.As(err, &ce) {
+				t.Error("unexpected error:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("error not reported")
+		}
+		if got := rule(); got != int64(2) {
+			t.Error("previous version not kept. got:", got)
+		}
+	})
+
+	t.Run("failed batch", func(t *testing.T) {
+		pl, err := trealla.New(trealla.WithMapDir("/rules", dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		write("a.pl", "a(1).\n")
+		write("b.pl", "b(1).\n")
+		for _, file := range []string{"/rules/a.pl", "/rules/b.pl"} {
+			if err := pl.Consult(ctx, file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := trealla.Watch(ctx, pl, trealla.WithWatchInterval(time.Hour))
+		defer w.Close()
+
+		write("a.pl", "a(2) :- .\n")
+		write("b.pl", "b(2).\n")
+		if err := w.Poll(ctx); err == nil {
+			t.Fatal("expected error")
+		}
+		if err := w.Poll(ctx); err != nil {
+			t.Error("failed reload retried without changes:", err)
+		}
+		write("a.pl", "a(2).\n")
+		if err := w.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		ans, err := pl.QueryOnce(ctx, "a(A), b(B).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, b := ans.Solution["A"], ans.Solution["B"]; a != int64(2) || b != int64(2) {
+			t.Error("files not reloaded. got:", a, b)
+		}
+	})
+
+	t.Run("module", func(t *testing.T) {
+		write("mod.pl", ":- module(mod, [value/1]).\nvalue(2).\n")
+		select {
+		case err := <-errs:
+			if err == nil || !strings.Contains(err.Error(), "module") {
+				t.Error("unexpected error:", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("error not reported")
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	pl, err := trealla.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.ConsultText(ctx, "user", "fact(1). fact(2). fact(3)."); err != nil {
+		t.Fatal(err)
+	}
+	// a query that's still running isn't part of the snapshot
+	q := pl.Query(ctx, "fact(X).")
+	defer q.Close()
+	if !q.Next(ctx) {
+		t.Fatal(q.Err())
+	}
+	snap, err := pl.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := trealla.NewFromSnapshot(bytes.NewReader(snap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	ans, err := restored.QueryOnce(ctx, `findall(X, fact(X), Xs), crypto_data_hash("a", H, [algorithm(sha256)]).`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []trealla.Term{int64(1), int64(2), int64(3)}; !reflect.DeepEqual(ans.Solution["Xs"], want) {
+		t.Error("bad solution. want:", want, "got:", ans.Solution["Xs"])
+	}
+	err = restored.Register(ctx, "native", 1, func(_ trealla.Prolog, _ trealla.Subquery, goal trealla.Term) trealla.Term {
+		return trealla.Atom("native").Of("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.QueryOnce(ctx, `native("ok").`); err != nil {
+		t.Error(err)
+	}
+
+	t.Run("register again", func(t *testing.T) {
+		native := func(_ trealla.Prolog, _ trealla.Subquery, goal trealla.Term) trealla.Term {
+			return trealla.Atom("native").Of(trealla.Atom("ok"))
+		}
+		snap, err := restored.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := trealla.NewFromSnapshot(bytes.NewReader(snap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer again.Close()
+		if err := again.Register(ctx, "native", 1, native); err != nil {
+			t.Fatal(err)
+		}
+		ans, err := again.QueryOnce(ctx, "findall(X, native(X), Xs).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []trealla.Term{trealla.Atom("ok")}; !reflect.DeepEqual(ans.Solution["Xs"], want) {
+			t.Error("bad solution. want:", want, "got:", ans.Solution["Xs"])
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		bad := slices.Clone(snap)
+		bad[7] = 99
+		// claims 4GB of memory but has none
+		huge := slices.Clone(snap[:100])
+		binary.LittleEndian.PutUint64(huge[len("TPLSNAP")+1+32+4+4:], 1<<32)
+		for _, data := range [][]byte{nil, []byte("hello world"), snap[:100], bad, huge} {
+			if _, err := trealla.NewFromSnapshot(bytes.NewReader(data)); err == nil {
+				t.Error("expected error")
+			}
+		}
+	})
+
+	t.Run("memory limit", func(t *testing.T) {
+		_, err := trealla.NewFromSnapshot(bytes.NewReader(snap), trealla.WithMemoryLimit(1024*1024))
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Error("unexpected error:", err)
+		}
+	})
+
+	t.Run("mounts", func(t *testing.T) {
+		var opts []trealla.Option
+		for i := range 8 {
+			text := fmt.Sprintf("mount(%d).\n", i)
+			opts = append(opts, trealla.WithMapFS(fmt.Sprintf("/m%d", i), fstest.MapFS{"m.pl": {Data: []byte(text)}}))
+		}
+		pl, err := trealla.New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		snap, err := pl.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slices.Reverse(opts)
+		restored, err := trealla.NewFromSnapshot(bytes.NewReader(snap), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		for i := range 8 {
+			ans, err := restored.QueryOnce(ctx, fmt.Sprintf("consult('/m%d/m.pl'), mount(X).", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ans.Solution["X"]; got != int64(i) {
+				t.Errorf("loaded the wrong file from /m%d. got: mount(%v)", i, got)
+			}
+		}
+
+		if _, err := trealla.NewFromSnapshot(bytes.NewReader(snap), opts[1:]...); err == nil {
+			t.Error("expected error for different mounts")
+		}
+	})
 }
 
 func TestBind(t *testing.T) {
@@ -574,3 +1151,342 @@ func TestConcurrencyDet100K(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestCancel(t *testing.T) {
+	t.Parallel()
+
+	pl, err := trealla.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := pl.QueryOnce(ctx, "repeat, fail.")
+		if !trealla.IsCanceled(err) {
+			t.Fatal("unexpected error:", err, "want ErrCanceled")
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Error("error should wrap context.DeadlineExceeded. got:", err)
+		}
+	})
+
+	t.Run("redo", func(t *testing.T) {
+		ctx := context.Background()
+		q := pl.Query(ctx, "X = 1 ; repeat, fail.")
+		if !q.Next(ctx) {
+			t.Fatal("expected an answer. err:", q.Err())
+		}
+		timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if q.Next(timeout) {
+			t.Error("unexpected answer:", q.Current())
+		}
+		if !errors.Is(q.Err(), context.DeadlineExceeded) {
+			t.Error("unexpected error:", q.Err(), "want context.DeadlineExceeded")
+		}
+		if err := q.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("already canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := pl.QueryOnce(ctx, "true.")
+		if !trealla.IsCanceled(err) {
+			t.Error("unexpected error:", err, "want ErrCanceled")
+		}
+	})
+
+	t.Run("still usable", func(t *testing.T) {
+		ans, err := pl.QueryOnce(context.Background(), "X is 1 + 1.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := ans.Solution["X"]; x != int64(2) {
+			t.Error("unexpected value. want: 2 got:", x)
+		}
+	})
+}
+
+func TestStreamOutput(t *testing.T) {
+	t.Parallel()
+
+	var plout strings.Builder
+	pl, err := trealla.New(trealla.WithStdoutWriter(&plout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	ctx := context.Background()
+	var stdout, stderr strings.Builder
+	var seen string
+	pl.Register(ctx, "peek_output", 0, func(_ trealla.Prolog, _ trealla.Subquery, goal trealla.Term) trealla.Term {
+		seen = stdout.String()
+		return goal
+	})
+
+	ans, err := pl.QueryOnce(ctx, `write(hello), peek_output, write(user_error, oops), write(' world').`,
+		trealla.WithStdout(&stdout), trealla.WithStderr(&stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != "hello" {
+		t.Errorf("output wasn't streamed before predicate call. want: %q got: %q", "hello", seen)
+	}
+	if got := stdout.String(); got != "hello world" {
+		t.Errorf("bad stdout. want: %q got: %q", "hello world", got)
+	}
+	if got := stderr.String(); got != "oops" {
+		t.Errorf("bad stderr. want: %q got: %q", "oops", got)
+	}
+	if ans.Stdout != "" || ans.Stderr != "" {
+		t.Errorf("streamed output shouldn't be captured. got stdout: %q stderr: %q", ans.Stdout, ans.Stderr)
+	}
+	if got := plout.String(); got != "hello world" {
+		t.Errorf("bad interpreter stdout. want: %q got: %q", "hello world", got)
+	}
+
+	ans, err = pl.QueryOnce(ctx, `write(captured).`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ans.Stdout != "captured" {
+		t.Errorf("bad captured stdout. want: %q got: %q", "captured", ans.Stdout)
+	}
+	if got := plout.String(); got != "hello worldcaptured" {
+		t.Errorf("bad interpreter stdout. want: %q got: %q", "hello worldcaptured", got)
+	}
+
+	// output shows up while a long query is still running, even if it can't be canceled
+	const long = `between(1, 200000, X), write(X), nl, fail ; true.`
+	partial := func(t *testing.T, chunks *chunkWriter) {
+		t.Helper()
+		if len(chunks.chunks) < 2 {
+			t.Errorf("output wasn't streamed while the query ran. writes: %d", len(chunks.chunks))
+		}
+		if len(chunks.chunks) > 0 && !strings.HasPrefix(chunks.chunks[0], "1\n") {
+			t.Errorf("bad first chunk: %.20q", chunks.chunks[0])
+		}
+	}
+	t.Run("partial WithStdout", func(t *testing.T) {
+		pl, err := trealla.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		var chunks chunkWriter
+		if _, err := pl.QueryOnce(context.Background(), long, trealla.WithStdout(&chunks)); err != nil {
+			t.Fatal(err)
+		}
+		partial(t, &chunks)
+	})
+	t.Run("partial WithStdoutWriter", func(t *testing.T) {
+		var chunks chunkWriter
+		pl, err := trealla.New(trealla.WithStdoutWriter(&chunks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		if _, err := pl.QueryOnce(context.Background(), long); err != nil {
+			t.Fatal(err)
+		}
+		partial(t, &chunks)
+	})
+}
+
+// chunkWriter records each write separately.
+type chunkWriter struct {
+	chunks []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func TestMaxOutput(t *testing.T) {
+	t.Parallel()
+
+	pl, err := trealla.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	ctx := context.Background()
+
+	t.Run("truncated", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, `write(hello), write(user_error, ' world').`, trealla.WithMaxOutput(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Stdout != "hello" || ans.Stderr != " wo" {
+			t.Errorf("bad output. stdout: %q stderr: %q", ans.Stdout, ans.Stderr)
+		}
+		if !ans.Truncated {
+			t.Error("answer should be marked as truncated")
+		}
+	})
+
+	t.Run("under limit", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, `write(hello).`, trealla.WithMaxOutput(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Stdout != "hello" || ans.Truncated {
+			t.Errorf("bad output. stdout: %q truncated: %v", ans.Stdout, ans.Truncated)
+		}
+	})
+
+	t.Run("runaway", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, `between(1, 1000000, X), write(X), nl, fail ; true.`, trealla.WithMaxOutput(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ans.Stdout) != 100 || !ans.Truncated {
+			t.Errorf("bad output. length: %d truncated: %v", len(ans.Stdout), ans.Truncated)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, `write(hello), fail.`, trealla.WithMaxOutput(2))
+		var failure trealla.ErrFailure
+		if !errors.As(err, &failure) {
+			t.Fatal("unexpected error:", err)
+		}
+		if failure.Stdout != "he" || !failure.Truncated {
+			t.Errorf("bad output. stdout: %q truncated: %v", failure.Stdout, failure.Truncated)
+		}
+	})
+
+	t.Run("throw", func(t *testing.T) {
+		_, err := pl.QueryOnce(ctx, `write(hello), throw(oops).`, trealla.WithMaxOutput(2))
+		var ex trealla.ErrThrow
+		if !errors.As(err, &ex) {
+			t.Fatal("unexpected error:", err)
+		}
+		if ex.Stdout != "he" || !ex.Truncated {
+			t.Errorf("bad output. stdout: %q truncated: %v", ex.Stdout, ex.Truncated)
+		}
+	})
+
+	t.Run("interpreter writer", func(t *testing.T) {
+		var plout strings.Builder
+		pl, err := trealla.New(trealla.WithStdoutWriter(&plout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		if _, err := pl.QueryOnce(ctx, `write(hello).`, trealla.WithMaxOutput(2)); err != nil {
+			t.Fatal(err)
+		}
+		if got := plout.String(); got != "he" {
+			t.Errorf("interpreter writer got output past the limit: %q", got)
+		}
+	})
+}
+
+func TestStdin(t *testing.T) {
+	t.Parallel()
+
+	pl, err := trealla.New(trealla.WithStdinReader(strings.NewReader("hello(world). ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	ctx := context.Background()
+
+	t.Run("WithStdinReader", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "read(X).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := trealla.Atom("hello").Of(trealla.Atom("world"))
+		if x := ans.Solution["X"]; !reflect.DeepEqual(x, want) {
+			t.Error("unexpected value. want:", want, "got:", x)
+		}
+	})
+
+	t.Run("WithStdin", func(t *testing.T) {
+		q := pl.Query(ctx, "repeat, read_term(user_input, X, []), (X == end_of_file -> ! ; true).",
+			trealla.WithStdin(strings.NewReader("a. b(1).\nc.")))
+		var got []trealla.Term
+		for ans := range q.All(ctx) {
+			got = append(got, ans.Solution["X"])
+		}
+		if err := q.Err(); err != nil {
+			t.Fatal(err)
+		}
+		want := []trealla.Term{trealla.Atom("a"), trealla.Atom("b").Of(int64(1)), trealla.Atom("c"), trealla.Atom("end_of_file")}
+		if !reflect.DeepEqual(want, got) {
+			t.Error("unexpected values. want:", want, "got:", got)
+		}
+	})
+
+	t.Run("get_char/1", func(t *testing.T) {
+		ans, err := pl.QueryOnce(ctx, "get_char(A), get_char(B).", trealla.WithStdin(strings.NewReader("xy")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, b := ans.Solution["A"], ans.Solution["B"]; a != trealla.Atom("x") || b != trealla.Atom("y") {
+			t.Error("unexpected values:", a, b)
+		}
+	})
+
+	t.Run("leftovers", func(t *testing.T) {
+		pl, err := trealla.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		if _, err := pl.QueryOnce(ctx, "read(X).", trealla.WithStdin(strings.NewReader("secret_a. secret_b.\nsecret_c.\n"))); err != nil {
+			t.Fatal(err)
+		}
+		// the interpreter reads a line at a time, so the rest of it is buffered,
+		// but neither the interpreter's stdin nor another query's sees it
+		ans, err := pl.QueryOnce(ctx, "read(X).")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := ans.Solution["X"]; x != trealla.Atom("end_of_file") {
+			t.Error("unexpected value:", x)
+		}
+		if _, err := pl.QueryOnce(ctx, "read(X).", trealla.WithStdin(strings.NewReader("secret_d. secret_e.\nsecret_f.\n"))); err != nil {
+			t.Fatal(err)
+		}
+		ans, err = pl.QueryOnce(ctx, "read(X).", trealla.WithStdin(strings.NewReader("mine.")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := ans.Solution["X"]; x != trealla.Atom("mine") {
+			t.Error("unexpected value:", x)
+		}
+	})
+
+	t.Run("interpreter leftovers", func(t *testing.T) {
+		pl, err := trealla.New(trealla.WithStdinReader(strings.NewReader("a. b.\nc.\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pl.Close()
+		read := func(opts ...trealla.QueryOption) trealla.Term {
+			t.Helper()
+			ans, err := pl.QueryOnce(ctx, "read(X).", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ans.Solution["X"]
+		}
+		// text buffered from the interpreter's stdin is kept for later queries
+		// while a query reads its own
+		got := []trealla.Term{read(), read(trealla.WithStdin(strings.NewReader("mine."))), read(), read()}
+		want := []trealla.Term{trealla.Atom("a"), trealla.Atom("mine"), trealla.Atom("b"), trealla.Atom("c")}
+		if !reflect.DeepEqual(want, got) {
+			t.Error("unexpected values. want:", want, "got:", got)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package trealla
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A snapshot is the interpreter's memory with a header:
+//
+//	magic    "TPLSNAP"
+//	version  1 byte
+//	hash     SHA-256 of libtpl.wasm, 32 bytes
+//	ptr      interpreter pointer, uint32 little endian
+//	mounts   mount layout size in bytes, uint32 little endian
+//	size     memory size in bytes, uint64 little endian
+//	layout   mounts bytes: the mount layout, NUL separated
+//	memory   size bytes
+const (
+	snapshotMagic      = "TPLSNAP"
+	snapshotVersion    = 2
+	snapshotHeaderSize = len(snapshotMagic) + 1 + 32 + 4 + 4 + 8
+	maxSnapshotLayout  = 1 << 16
+)
+
+type snapshot struct {
+	ptr    uint32
+	layout []string
+	memory []byte
+}
+
+func (pl *prolog) Snapshot() ([]byte, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return nil, io.EOF
+	}
+	return pl.snapshot()
+}
+
+func (pl *prolog) snapshot() ([]byte, error) {
+	src := pl
+	if len(pl.running) > 0 || len(pl.spawning) > 0 {
+		// cloning frees the queries that are still running
+		clone, err := pl.clone()
+		if err != nil {
+			return nil, err
+		}
+		defer clone.Close()
+		src = clone
+	}
+	memory, _ := src.memory.Read(0, src.memory.Size())
+	hash := pl.hash
+	layout := strings.Join(pl.mountLayout(), "\x00")
+
+	buf := make([]byte, 0, snapshotHeaderSize+len(layout)+len(memory))
+	buf = append(buf, snapshotMagic...)
+	buf = append(buf, snapshotVersion)
+	buf = append(buf, hash[:]...)
+	buf = binary.LittleEndian.AppendUint32(buf, src.ptr)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(layout)))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(memory)))
+	buf = append(buf, layout...)
+	buf = append(buf, memory...)
+	return buf, nil
+}
+
+func (pl *lockedProlog) Snapshot() ([]byte, error) {
+	if err := pl.ensure(); err != nil {
+		return nil, err
+	}
+	return pl.prolog.snapshot()
+}
+
+// NewFromSnapshot creates a new Prolog interpreter from an image made by [Prolog.Snapshot].
+// This is much faster than starting an interpreter and consulting the same code.
+//
+// The snapshot must have been made with the same interpreter build (see [WithWASM]).
+// Settings used at startup, such as [WithLibraryPath], [WithTrace], and [WithQuiet], come from the snapshot.
+// Other options apply as usual, but directories and file systems must be given again
+// and native predicates must be registered again.
+// The snapshot must be restored with the same directories and file systems
+// (by alias, see [WithMapDir] and [WithMapFS]) and with a [WithLibraryResolver] exactly when it was made with one.
+func NewFromSnapshot(r io.Reader, opts ...Option) (Prolog, error) {
+	pl := newProlog(opts)
+	snap, err := readSnapshot(r, pl.hash, uint64(pl.memoryPages())*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return pl, pl.init(nil, snap)
+}
+
+// readSnapshot reads a snapshot made by the interpreter build with the given hash,
+// whose memory is at most limit bytes.
+func readSnapshot(r io.Reader, hash [sha256.Size]byte, limit uint64) (*snapshot, error) {
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("trealla: failed to read snapshot: %w", err)
+	}
+	magic, header := header[:len(snapshotMagic)], header[len(snapshotMagic):]
+	if string(magic) != snapshotMagic {
+		return nil, fmt.Errorf("trealla: not a snapshot")
+	}
+	if header[0] != snapshotVersion {
+		return nil, fmt.Errorf("trealla: unsupported snapshot version: %d", header[0])
+	}
+	if !bytes.Equal(header[1:33], hash[:]) {
+		return nil, fmt.Errorf("trealla: snapshot was made by a different build of the interpreter")
+	}
+	snap := &snapshot{ptr: binary.LittleEndian.Uint32(header[33:37])}
+	mounts := binary.LittleEndian.Uint32(header[37:41])
+	size := binary.LittleEndian.Uint64(header[41:49])
+	if mounts > maxSnapshotLayout {
+		return nil, fmt.Errorf("trealla: snapshot mount layout too large: %d bytes", mounts)
+	}
+	if size > maxPages*pageSize || size > limit {
+		return nil, fmt.Errorf("trealla: snapshot too large: %d bytes", size)
+	}
+	layout := make([]byte, mounts)
+	if _, err := io.ReadFull(r, layout); err != nil {
+		return nil, fmt.Errorf("trealla: failed to read snapshot: %w", err)
+	}
+	snap.layout = strings.Split(string(layout), "\x00")
+	// the buffer grows as the memory is read, so a bad size can't allocate much more than r has
+	var memory bytes.Buffer
+	if _, err := io.CopyN(&memory, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("trealla: failed to read snapshot: %w", err)
+	}
+	snap.memory = memory.Bytes()
+	return snap, nil
+}
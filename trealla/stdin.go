@@ -0,0 +1,118 @@
+package trealla
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// inputReader is the standard input of an interpreter instance.
+// It reads from the running query's reader, falling back to the interpreter's default.
+type inputReader struct {
+	r        io.Reader
+	fallback io.Reader
+
+	// the interpreter hit the end of a reader, and it was a query's reader
+	eof      bool
+	eofQuery bool
+	// the interpreter read text that it might still be buffering, and it was from a query's reader
+	read      bool
+	readQuery bool
+}
+
+func (in *inputReader) Read(p []byte) (int, error) {
+	r := in.r
+	if r == nil {
+		r = in.fallback
+	}
+	if r == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Read(p)
+	if err == io.EOF {
+		in.eof = true
+		in.eofQuery = in.r != nil
+	} else if n > 0 {
+		in.eof = false
+	}
+	if n > 0 {
+		in.read = true
+		in.readQuery = in.r != nil
+	}
+	return n, err
+}
+
+// use switches to reading from r (if not nil) and returns a function that switches back.
+func (in *inputReader) use(r io.Reader) (restore func()) {
+	if r == nil {
+		return func() {}
+	}
+	prev := in.r
+	in.r = r
+	return func() {
+		in.r = prev
+	}
+}
+
+// stale returns true if the interpreter might remember reaching the end of a previous reader,
+// or still buffer text from it, when it switches to next.
+// Text left over from another query's reader must not leak into the next query.
+func (in *inputReader) stale(next io.Reader) bool {
+	if !in.eof && !in.read {
+		return false
+	}
+	if next != nil {
+		return true
+	}
+	return in.r == nil && ((in.eof && in.eofQuery) || (in.read && in.readQuery))
+}
+
+// resetInput prepares the interpreter to read from next (or the current reader if nil).
+// Interpreters buffer their input and remember reaching the end of it,
+// so both need to be cleared when switching readers.
+// Text buffered from the interpreter's own reader is meant for later queries, so it's kept.
+func (pl *prolog) resetInput(next io.Reader) error {
+	if !pl.input.stale(next) {
+		return nil
+	}
+	keep := pl.input.read && !pl.input.readQuery
+	defer func() {
+		pl.input.eof = false
+		pl.input.read = false
+	}()
+	// read whatever is left over from the previous reader until the end,
+	// which also clears the remembered end
+	restore := pl.input.use(eofReader{})
+	defer restore()
+	text := "repeat, get_char(user_input, C), C == end_of_file, !."
+	if keep {
+		text = "repeat, get_char(user_input, C), (C == end_of_file -> !, flush_output ; put_char(C), fail)."
+	}
+	goal, err := newCString(pl, text)
+	if err != nil {
+		return err
+	}
+	defer goal.free(pl)
+	if _, err := pl.pl_eval.Call(pl.ctx, uint64(pl.ptr), uint64(goal.ptr), 0); err != nil {
+		return fmt.Errorf("trealla: failed to reset stdin: %w", err)
+	}
+	if !keep {
+		return nil
+	}
+	drain := &query{pl: pl}
+	defer drain.freeCapture()
+	leftover, _, err := drain.readCapture()
+	if err != nil {
+		return fmt.Errorf("trealla: failed to reset stdin: %w", err)
+	}
+	if leftover != "" {
+		pl.input.fallback = io.MultiReader(strings.NewReader(leftover), pl.input.fallback)
+	}
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -51,6 +51,29 @@ func (sub Substitution) Scan(obj any) error {
 	return scan(sub, rv)
 }
 
+// apply returns a copy of x with its variables replaced by their substitutions.
+func (sub Substitution) apply(x Term) Term {
+	switch x := x.(type) {
+	case Variable:
+		if value, ok := sub[x.Name]; ok {
+			return value
+		}
+	case Compound:
+		args := make([]Term, len(x.Args))
+		for i, arg := range x.Args {
+			args[i] = sub.apply(arg)
+		}
+		return Compound{Functor: x.Functor, Args: args}
+	case []Term:
+		list := make([]Term, len(x))
+		for i, elem := range x {
+			list[i] = sub.apply(elem)
+		}
+		return list
+	}
+	return x
+}
+
 type bindings []binding
 
 func (bs bindings) String() string {
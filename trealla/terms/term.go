@@ -34,6 +34,21 @@ func ResourceError(what trealla.Atom, ctx trealla.Term) trealla.Compound {
 	return trealla.Atom("error").Of(trealla.Atom("resource_error").Of(what), ctx)
 }
 
+// SyntaxError returns a term in the form of error(syntax_error(What), Ctx).
+func SyntaxError(what trealla.Term, ctx trealla.Term) trealla.Compound {
+	return trealla.Atom("error").Of(trealla.Atom("syntax_error").Of(what), ctx)
+}
+
+// EvaluationError returns a term in the form of error(evaluation_error(What), Ctx).
+func EvaluationError(what trealla.Atom, ctx trealla.Term) trealla.Compound {
+	return trealla.Atom("error").Of(trealla.Atom("evaluation_error").Of(what), ctx)
+}
+
+// InstantiationError returns a term in the form of error(instantiation_error, Ctx).
+func InstantiationError(ctx trealla.Term) trealla.Compound {
+	return trealla.Atom("error").Of(trealla.Atom("instantiation_error"), ctx)
+}
+
 // SystemError returns a term in the form of error(system_error(What), Ctx).
 func SystemError(what, ctx trealla.Term) trealla.Compound {
 	return trealla.Atom("error").Of(trealla.Atom("system_error").Of(what), ctx)
@@ -2,7 +2,12 @@ package trealla
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
@@ -12,38 +17,186 @@ import (
 //go:embed libtpl.wasm
 var tplWASM []byte
 
-type wasmFunc = api.Function
+// wasmHash identifies the build of the interpreter, see [Prolog.Snapshot].
+var wasmHash = sync.OnceValue(func() [sha256.Size]byte {
+	return sha256.Sum256(tplWASM)
+})
 
-var wasmEngine wazero.Runtime
-var wasmModule wazero.CompiledModule
+// wasmFunc is a function exported by the interpreter.
+// Calls can nest when a native predicate calls back into Prolog,
+// but a wazero function can't be re-entered, so nested calls use a fresh copy.
+type wasmFunc struct {
+	fn     api.Function
+	module api.Module
+	name   string
+	busy   bool
+}
+
+func (f *wasmFunc) Call(ctx context.Context, params ...uint64) ([]uint64, error) {
+	if f.busy {
+		return f.module.ExportedFunction(f.name).Call(ctx, params...)
+	}
+	f.busy = true
+	defer func() {
+		f.busy = false
+	}()
+	return f.fn.Call(ctx, params...)
+}
+
+// cacheDirEnv names an environment variable that sets the compilation cache directory
+// if [SetCompilationCacheDir] isn't called.
+const cacheDirEnv = "TREALLA_CACHE_DIR"
+
+// wasmCache shares compiled code between runtimes.
+// It's created on first use.
+var wasmCache struct {
+	cache wazero.CompilationCache
+	dir   string
+	set   bool
+	mu    sync.Mutex
+}
+
+// runtimeKey identifies a runtime and the interpreter compiled for it.
+type runtimeKey struct {
+	// cfg is from WithRuntimeConfig, or nil for the default; each value gets its own runtime
+	cfg wazero.RuntimeConfig
+	// hash is the SHA-256 of the interpreter's wasm
+	hash [sha256.Size]byte
+	// pages is the memory limit from WithMemoryLimit, or 0 for none
+	pages uint32
+	// host is from WithHostFunctions, or nil for none
+	host *hostFunctions
+}
+
+// runtimes holds the runtimes interpreters were created with.
+// They are created on first use, so that importing this package doesn't compile anything.
+var runtimes = struct {
+	engines map[runtimeKey]wazero.Runtime
+	modules map[runtimeKey]wazero.CompiledModule
+	mu      sync.Mutex
+}{
+	engines: make(map[runtimeKey]wazero.Runtime),
+	modules: make(map[runtimeKey]wazero.CompiledModule),
+}
+
+// requiredExports are the functions the interpreter's wasm must export.
+var requiredExports = []string{
+	"canonical_abi_realloc",
+	"canonical_abi_free",
+	"pl_global",
+	"pl_capture",
+	"pl_capture_read",
+	"pl_capture_reset",
+	"pl_capture_free",
+	"pl_query",
+	"pl_redo",
+	"pl_done",
+	"pl_yield_at",
+	"pl_eval",
+	"query_did_yield",
+}
+
+// SetCompilationCacheDir makes the interpreter's compiled code persist in dir,
+// so that processes after the first one start faster.
+// It must be called before the first interpreter is created.
+// By default, the directory is taken from the TREALLA_CACHE_DIR environment variable,
+// and if that is unset, compiled code is only cached in memory.
+func SetCompilationCacheDir(dir string) error {
+	wasmCache.mu.Lock()
+	defer wasmCache.mu.Unlock()
+	if wasmCache.cache != nil {
+		return fmt.Errorf("trealla: compilation cache is already in use")
+	}
+	wasmCache.dir = dir
+	wasmCache.set = true
+	return nil
+}
 
-func init() {
-	ctx := context.Background()
-	wasmEngine = wazero.NewRuntime(ctx)
-	wasi_snapshot_preview1.MustInstantiate(ctx, wasmEngine)
+func compilationCache() (wazero.CompilationCache, error) {
+	wasmCache.mu.Lock()
+	defer wasmCache.mu.Unlock()
+	if wasmCache.cache != nil {
+		return wasmCache.cache, nil
+	}
+	dir := wasmCache.dir
+	if !wasmCache.set {
+		dir = os.Getenv(cacheDirEnv)
+	}
+	if dir == "" {
+		wasmCache.cache = wazero.NewCompilationCache()
+		return wasmCache.cache, nil
+	}
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("trealla: failed to open compilation cache: %w", err)
+	}
+	wasmCache.cache = cache
+	return cache, nil
+}
+
+// loadRuntime returns the runtime for key, compiling wasm for it the first time.
+func loadRuntime(key runtimeKey, wasm []byte) (wazero.Runtime, wazero.CompiledModule, error) {
+	runtimes.mu.Lock()
+	defer runtimes.mu.Unlock()
+	if engine, ok := runtimes.engines[key]; ok {
+		return engine, runtimes.modules[key], nil
+	}
+	cfg := key.cfg
+	if cfg == nil {
+		cfg = wazero.NewRuntimeConfig()
+	}
+	if key.pages > 0 {
+		cfg = cfg.WithMemoryLimitPages(key.pages)
+	}
+	engine, module, err := newRuntime(context.Background(), cfg, wasm, key.host)
+	if err != nil {
+		return nil, nil, err
+	}
+	runtimes.engines[key] = engine
+	runtimes.modules[key] = module
+	return engine, module, nil
+}
 
-	_, err := wasmEngine.NewHostModuleBuilder("trealla").
-		NewFunctionBuilder().WithFunc(hostCall).Export("host-call").
-		NewFunctionBuilder().WithFunc(hostResume).Export("host-resume").
-		NewFunctionBuilder().WithFunc(hostPushAnswer).Export("host-push-answer").
-		Instantiate(ctx)
+func newRuntime(ctx context.Context, cfg wazero.RuntimeConfig, wasm []byte, host *hostFunctions) (wazero.Runtime, wazero.CompiledModule, error) {
+	cache, err := compilationCache()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	engine := wazero.NewRuntimeWithConfig(ctx, cfg.WithCompilationCache(cache))
+	wasi_snapshot_preview1.MustInstantiate(ctx, engine)
+	if err := host.instantiate(ctx, engine); err != nil {
+		engine.Close(ctx)
+		return nil, nil, err
 	}
 
-	wasmModule, err = wasmEngine.CompileModule(ctx, tplWASM)
+	module, err := engine.CompileModule(ctx, wasm)
 	if err != nil {
-		panic(err)
+		engine.Close(ctx)
+		return nil, nil, err
+	}
+	var missing []string
+	for _, name := range requiredExports {
+		if _, ok := module.ExportedFunctions()[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		engine.Close(ctx)
+		return nil, nil, fmt.Errorf("trealla: wasm module is missing required exports: %s", strings.Join(missing, ", "))
 	}
+	return engine, module, nil
 }
 
 var (
 	wasmFalse uint32 = 0
 	wasmTrue  uint32 = 1
+	// host_call result that suspends the query until host_resume
+	wasmYield uint32 = 2
 )
 
 const (
 	ptrSize  = 4
 	align    = 1
 	pageSize = 64 * 1024
+	maxPages = 65536 // 4GB, the most a wasm32 memory can address
 )
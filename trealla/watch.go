@@ -0,0 +1,311 @@
+package trealla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWatchInterval is how often a [Watcher] checks for changes by default.
+const defaultWatchInterval = time.Second
+
+// Watcher reloads files loaded by [Prolog.Consult] when they change.
+// It polls the files' modification times and sizes, so it works with any directory
+// granted by [WithPreopenDir], [WithMapDir], or [WithMapFS].
+//
+// Changed files are consulted again, in the order they were first consulted.
+// Reloads are atomic: if loading any of the files fails, the interpreter is rolled back
+// to before the reload, and the error is reported to the function given by [WithWatchError].
+// The files stay changed until a reload succeeds, so fixing the file that failed
+// reloads the others that changed with it.
+//
+// Consulting a file again replaces the predicates it defines.
+// The interpreter can't reload files that declare a module, so changing one is reported as an error
+// and none of the changed files are reloaded.
+type Watcher struct {
+	target   reloader
+	interval time.Duration
+	onError  func(error)
+	extra    []string
+
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+	// failed are the stamps of the last reload that failed, so it isn't retried until something changes.
+	failed map[string]fileStamp
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WatchOption is an optional parameter for [Watch].
+type WatchOption func(*Watcher)
+
+// WithWatchInterval sets how often the Watcher checks files for changes.
+// The default is one second.
+func WithWatchInterval(interval time.Duration) WatchOption {
+	return func(w *Watcher) {
+		w.interval = interval
+	}
+}
+
+// WithWatchError sets a function that is called when reloading fails.
+func WithWatchError(fn func(error)) WatchOption {
+	return func(w *Watcher) {
+		w.onError = fn
+	}
+}
+
+// WithWatchFiles watches files that weren't loaded by [Prolog.Consult],
+// such as files loaded by directives or include/1.
+// When one of them changes, it is consulted like the others.
+func WithWatchFiles(names ...string) WatchOption {
+	return func(w *Watcher) {
+		w.extra = append(w.extra, names...)
+	}
+}
+
+// reloader is something a Watcher can reload files into.
+type reloader interface {
+	// consulted returns the files loaded by Consult, in order.
+	consulted() []string
+	// stat returns information about a file in the interpreter's file system.
+	stat(name string) (fs.FileInfo, error)
+	// reload consults files again, all or nothing.
+	reload(ctx context.Context, files []string) error
+}
+
+// Watch starts watching the files pl has consulted, reloading them when they change.
+// It stops when ctx is canceled or [Watcher.Close] is called.
+func Watch(ctx context.Context, pl Prolog, options ...WatchOption) *Watcher {
+	return newWatcher(ctx, pl.(reloader), options)
+}
+
+func newWatcher(ctx context.Context, target reloader, options []WatchOption) *Watcher {
+	w := &Watcher{
+		target:   target,
+		interval: defaultWatchInterval,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(w)
+	}
+	_, w.stamps = w.changed()
+	ctx, w.cancel = context.WithCancel(ctx)
+	go w.run(ctx)
+	return w
+}
+
+func (w *Watcher) run(ctx context.Context) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := w.Poll(ctx); err != nil && w.onError != nil && ctx.Err() == nil {
+			w.onError(err)
+		}
+	}
+}
+
+// Poll checks for changes now, reloading any changed files.
+// It returns the error from reloading, if any, instead of reporting it.
+func (w *Watcher) Poll(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files, stamps := w.changed()
+	if len(files) == 0 {
+		w.stamps = stamps
+		return nil
+	}
+	if maps.Equal(stamps, w.failed) {
+		return nil
+	}
+	if err := w.target.reload(ctx, files); err != nil {
+		w.failed = stamps
+		return err
+	}
+	w.stamps, w.failed = stamps, nil
+	return nil
+}
+
+// Close stops watching. It waits for a reload in progress to finish.
+func (w *Watcher) Close() {
+	w.cancel()
+	<-w.done
+}
+
+// changed returns the watched files that changed since the last successful reload,
+// and the current stamps of all the watched files.
+func (w *Watcher) changed() ([]string, map[string]fileStamp) {
+	var files []string
+	stamps := make(map[string]fileStamp)
+	for _, name := range append(w.target.consulted(), w.extra...) {
+		if _, ok := stamps[name]; ok {
+			continue
+		}
+		fi, err := w.target.stat(name)
+		if err != nil {
+			// removed, or not somewhere we can see it
+			continue
+		}
+		stamp := fileStamp{mod: fi.ModTime(), size: fi.Size()}
+		old, ok := w.stamps[name]
+		stamps[name] = stamp
+		if ok && old != stamp {
+			files = append(files, name)
+		}
+	}
+	return files, stamps
+}
+
+// fileStamp is what a Watcher compares to tell whether a file changed.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func (pl *prolog) consulted() []string {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return slices.Clone(pl.sources)
+}
+
+// stat finds a file in the interpreter's file system, like consult/1 does:
+// relative to the root, trying a .pl extension if needed.
+func (pl *prolog) stat(name string) (fs.FileInfo, error) {
+	name = path.Join("/", name)
+	fi, err := pl.statMount(name)
+	if err == nil && !fi.IsDir() {
+		return fi, nil
+	}
+	if !strings.HasSuffix(name, ".pl") {
+		if fi, err := pl.statMount(name + ".pl"); err == nil {
+			return fi, nil
+		}
+	}
+	if err == nil {
+		err = &fs.PathError{Op: "stat", Path: name, Err: errors.New("is a directory")}
+	}
+	return nil, err
+}
+
+// statMount stats the absolute path name in the directory or file system mounted closest to it.
+func (pl *prolog) statMount(name string) (fs.FileInfo, error) {
+	var mount, rest string
+	match := func(alias string) bool {
+		alias = path.Join("/", alias)
+		r, ok := strings.CutPrefix(name, alias)
+		if !ok || (r != "" && r[0] != '/' && alias != "/") || len(alias) <= len(mount) {
+			return false
+		}
+		mount, rest = alias, strings.TrimPrefix(r, "/")
+		return true
+	}
+	var dir string
+	var fsys fs.FS
+	for alias, d := range pl.dirs {
+		if match(alias) {
+			dir, fsys = d, nil
+		}
+	}
+	for alias, f := range pl.fs {
+		if match(alias) {
+			dir, fsys = "", f
+		}
+	}
+	switch {
+	case fsys != nil:
+		if rest == "" {
+			rest = "."
+		}
+		return fs.Stat(fsys, rest)
+	case dir != "":
+		return os.Stat(filepath.Join(dir, filepath.FromSlash(rest)))
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (pl *prolog) reload(ctx context.Context, files []string) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.instance == nil {
+		return io.EOF
+	}
+	return pl.reloadFiles(ctx, files)
+}
+
+// reloadFiles consults files again, rolling pl back if any of them fails to load.
+func (pl *prolog) reloadFiles(ctx context.Context, files []string) error {
+	for _, file := range files {
+		// consult/1 keeps the version of a module that's already loaded
+		if pl.declaresModule(ctx, file) {
+			return fmt.Errorf("trealla: can't reload module file: %s", file)
+		}
+	}
+	cp := pl.checkpoint()
+	for _, file := range files {
+		if err := pl.consult(ctx, file); err != nil {
+			if rerr := pl.rollback(cp); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// declaresModule reports whether file starts with a module declaration.
+func (pl *prolog) declaresModule(ctx context.Context, file string) bool {
+	// \+ \+ ((exists_file(File) -> Path = File ; atom_concat(File, '.pl', Path)),
+	// setup_call_cleanup(open(Path, read, S), read_term(S, (:- module(_, _)), []), close(S))).
+	// The double negation keeps the stream out of the answer.
+	path, stream, anon := Variable{Name: "Path"}, Variable{Name: "S"}, Variable{Name: "_"}
+	goal := Atom(",").Of(
+		Atom(";").Of(
+			Atom("->").Of(Atom("exists_file").Of(Atom(file)), Atom("=").Of(path, Atom(file))),
+			Atom("atom_concat").Of(Atom(file), Atom(".pl"), path),
+		),
+		Atom("setup_call_cleanup").Of(
+			Atom("open").Of(path, Atom("read"), stream),
+			Atom("read_term").Of(stream, Atom(":-").Of(Atom("module").Of(anon, anon)), []Term{}),
+			Atom("close").Of(stream),
+		),
+	)
+	_, err := pl.queryOnce(ctx, Atom(`\+`).Of(Atom(`\+`).Of(goal)).String()+".")
+	return err == nil
+}
+
+func (pl *lockedProlog) consulted() []string {
+	return slices.Clone(pl.prolog.sources)
+}
+
+func (pl *lockedProlog) stat(name string) (fs.FileInfo, error) {
+	return pl.prolog.stat(name)
+}
+
+func (pl *lockedProlog) reload(ctx context.Context, files []string) error {
+	if err := pl.ensure(); err != nil {
+		return err
+	}
+	return pl.prolog.reloadFiles(ctx, files)
+}
+
+var (
+	_ reloader = (*prolog)(nil)
+	_ reloader = (*lockedProlog)(nil)
+	_ reloader = (*Pool)(nil)
+)